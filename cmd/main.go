@@ -7,18 +7,27 @@ import (
 	"dns-proxy/pkg/controller/tcp"
 	"dns-proxy/pkg/controller/udp"
 
+	"dns-proxy/pkg/domain/allowlist"
+	"dns-proxy/pkg/domain/denylist"
+	"dns-proxy/pkg/domain/policy"
 	"dns-proxy/pkg/domain/proxy"
 
+	"dns-proxy/pkg/gateway/blocklist"
 	"dns-proxy/pkg/gateway/cache"
 	"dns-proxy/pkg/gateway/logger"
 	"dns-proxy/pkg/gateway/parser"
+	"dns-proxy/pkg/gateway/repository"
 	"dns-proxy/pkg/gateway/resolver"
 
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"runtime"
+	"strings"
 	"time"
+	// Embedded timezone database for the schedules, since the container image may not have one.
+	_ "time/tzdata"
 )
 
 func main() {
@@ -29,30 +38,105 @@ func main() {
 	}
 	fmt.Printf("%+v\n", cfg)
 
-	// Create and start cacheUDP autopurge.
-	cacheUDP := cache.New(
+	// Create and start cache autopurge.
+	eviction, err := cache.ParseEviction(cfg.CacheEviction)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dnsCache := cache.New(
+		time.Duration(cfg.CacheMinTTL)*time.Second,
 		time.Duration(cfg.CacheTTL)*time.Second,
-		logger.New("UDP CACHE", true),
+		time.Duration(cfg.CacheMaxNegativeTTL)*time.Second,
+		time.Duration(cfg.CacheStaleWindow)*time.Second,
+		time.Duration(cfg.CacheStaleTTL)*time.Second,
+		cfg.CachePrefetchHits,
+		eviction,
+		cfg.CacheMaxEntries,
+		cfg.CacheMaxBytes,
+		cfg.CacheShards,
+		logger.New("CACHE", true),
 		cfg.CacheEnabled,
 	)
+	go dnsCache.Flush()
 
-	cacheTCP := cache.New(
-		time.Duration(cfg.CacheTTL)*time.Second,
-		logger.New("TCP CACHE", true),
-		cfg.CacheEnabled,
-	)
+	// Default answer for denied domains. Denylist entries can override it.
+	blockMode, err := denylist.ParseMode(cfg.BlockMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := denylist.ValidateSinkhole(cfg.BlockSinkhole); err != nil {
+		log.Fatal(err)
+	}
+	if blockMode == denylist.ModeSinkhole && len(cfg.BlockSinkhole) == 0 {
+		log.Fatal("PRONSY_BLOCKSINKHOLE is empty with the sinkhole block mode")
+	}
+
+	// The denylist and allowlist are kept in memory unless a database file is configured.
+	memory := repository.NewMemory()
+	var denyRepo denylist.Repository = memory
+	var allowRepo allowlist.Repository = memory
+	if cfg.DatabasePath != "" {
+		db, err := repository.NewBolt(cfg.DatabasePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+		denyRepo, allowRepo = db, db
+	}
+	denySvc, err := denylist.NewService(denyRepo, cfg.BlockSinkhole)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go denySvc.Flush()
+	allowSvc, err := allowlist.NewService(allowRepo)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	go cacheTCP.Flush()
-	go cacheUDP.Flush()
+	// Import the blocklists into the denylist and keep them updated.
+	if len(cfg.Blocklists) > 0 {
+		importer := blocklist.New(
+			denySvc,
+			cfg.Blocklists,
+			time.Duration(cfg.BlocklistsRefresh)*time.Minute,
+			logger.New("BLOCKLIST", true),
+		)
+		go importer.Refresh()
+	}
 
-	// denySvc := denylist.NewService(nil)
+	// Policy groups of the clients.
+	groups, err := policyGroups(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Resolver of the DNS Providers, and of the zones forwarded to other upstreams.
+	addresses, err := providerAddresses(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dnsResolver, err := newResolver(cfg, "RESOLVER", addresses)
+	if err != nil {
+		log.Fatal(err)
+	}
+	routes, err := forwardRoutes(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Create DNS Proxy injecting dependencies.
+	dnsParser := parser.NewDNSParser()
 	proxySvc := proxy.NewDNSProxy(
-		resolver.New(cfg.ProviderHost, cfg.ProviderPort, cfg.ResolverTimeOut),
-		nil, //denySvc
-		parser.NewDNSParser(),
-		cacheUDP,
+		dnsResolver,
+		routes,
+		denySvc,
+		allowSvc,
+		policy.NewService(groups),
+		proxy.Blocking{Mode: blockMode, Sinkhole: cfg.BlockSinkhole},
+		dnsParser,
+		dnsCache,
+		time.Duration(cfg.CacheStaleTimeOut)*time.Millisecond,
+		time.Duration(cfg.CacheStaleRecheck)*time.Second,
 		logger.New("PROXY", true),
 	)
 
@@ -63,8 +147,6 @@ func main() {
 			2400,
 			cfg.UDPMaxQueueSize,
 			logger.New("UDP HANDLER", true),
-			cacheUDP,
-			parser.NewDNSParser(),
 		),
 		logger.New("UDP SERVER", true),
 		cfg.Port,
@@ -75,9 +157,8 @@ func main() {
 		proxySvc,
 		tcp.NewTCPHandler(
 			2400,
+			dnsParser,
 			logger.New("TCP HANDLER", true),
-			cacheTCP,
-			parser.NewDNSParser(),
 		),
 		logger.New("TCP SERVER", true),
 		cfg.Port,
@@ -88,7 +169,167 @@ func main() {
 	go TCPDNSProxy.Serve()
 	go UDPDNSProxy.Serve()
 
-	// TODO: API to handle blocked domains. Not implemented.
-	router := rest.Handler(nil)
+	// REST API to manage the denylist and the allowlist, and to look at the cache.
+	router := rest.Handler(denySvc, allowSvc, dnsCache)
 	log.Fatal(http.ListenAndServe(":8080", router))
 }
+
+// policyGroups builds the policy groups from the networks and lists of the configuration.
+func policyGroups(cfg *config.Config) ([]policy.Group, error) {
+	var groups []policy.Group
+	for name, cidrs := range cfg.Groups {
+		group := policy.Group{
+			Name:       name,
+			Denylists:  config.List(cfg.GroupDenylists[name]),
+			Allowlists: config.List(cfg.GroupAllowlists[name]),
+		}
+		if schedule, ok := cfg.GroupSchedules[name]; ok {
+			parsed, err := denylist.ParseSchedule(schedule)
+			if err != nil {
+				return nil, fmt.Errorf("group %s: %w", name, err)
+			}
+			group.Schedule = parsed
+		}
+		for _, cidr := range config.List(cidrs) {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("group %s: %w", name, err)
+			}
+			group.Networks = append(group.Networks, network)
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// newResolver builds the resolver of the DNS Providers. With a single provider queries go straight to it,
+// otherwise they are balanced among the providers.
+func newResolver(cfg *config.Config, name string, addresses []resolver.Address) (proxy.Resolver, error) {
+	strategy, err := resolver.ParseStrategy(cfg.ProviderStrategy)
+	if err != nil {
+		return nil, err
+	}
+	var providers []resolver.Provider
+	for _, address := range addresses {
+		provider, err := newProvider(cfg, address)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %w", address, err)
+		}
+		providers = append(providers, resolver.Provider{Name: address.String(), Resolver: provider})
+	}
+	if len(providers) == 1 {
+		return providers[0].Resolver, nil
+	}
+	return resolver.NewBalancer(
+		providers,
+		strategy,
+		cfg.ProviderMaxFails,
+		time.Duration(cfg.ResolverTimeOut)*time.Millisecond,
+		time.Duration(cfg.ProviderProbeInterval)*time.Second,
+		logger.New(name, true),
+	)
+}
+
+// newProvider builds the resolver of a single DNS Provider for its protocol.
+func newProvider(cfg *config.Config, address resolver.Address) (proxy.Resolver, error) {
+	switch address.Protocol {
+	case resolver.ProtocolTCP:
+		return resolver.NewTCP(
+			address.Host,
+			address.Port,
+			cfg.ResolverTimeOut,
+			cfg.ResolverPoolSize,
+			cfg.ResolverIdleTimeOut,
+		), nil
+	case resolver.ProtocolUDP:
+		return resolver.NewUDP(
+			address.Host,
+			address.Port,
+			cfg.ResolverTimeOut,
+			cfg.ResolverPoolSize,
+			cfg.ResolverIdleTimeOut,
+		), nil
+	}
+	tlsConfig, err := resolver.NewTLSConfig(address.ServerName, cfg.ProviderCAFile, address.Pins)
+	if err != nil {
+		return nil, err
+	}
+	switch address.Protocol {
+	case resolver.ProtocolQUIC:
+		return resolver.NewDoQ(
+			address.Host,
+			address.Port,
+			cfg.ResolverTimeOut,
+			cfg.ResolverIdleTimeOut,
+			tlsConfig,
+		), nil
+	case resolver.ProtocolHTTPS:
+		return resolver.NewDoH(
+			address.String(),
+			address.Method,
+			cfg.ResolverTimeOut,
+			cfg.ResolverPoolSize,
+			cfg.ResolverIdleTimeOut,
+			tlsConfig,
+		), nil
+	}
+	return resolver.New(
+		address.Host,
+		address.Port,
+		cfg.ResolverTimeOut,
+		cfg.ResolverPoolSize,
+		cfg.ResolverIdleTimeOut,
+		tlsConfig,
+	), nil
+}
+
+// providerAddresses returns the addresses of the DNS Providers, or the one of ProviderHost if there are none.
+func providerAddresses(cfg *config.Config) ([]resolver.Address, error) {
+	if len(cfg.Providers) == 0 {
+		return []resolver.Address{{
+			Protocol:   resolver.ProtocolTLS,
+			Host:       cfg.ProviderHost,
+			Port:       cfg.ProviderPort,
+			ServerName: cfg.ProviderServerName,
+			Pins:       cfg.ProviderPins,
+		}}, nil
+	}
+	return parseAddresses(cfg.Providers)
+}
+
+// forwardRoutes builds the routes forwarding zones to the named upstreams.
+func forwardRoutes(cfg *config.Config) ([]proxy.Route, error) {
+	upstreams := make(map[string]proxy.Resolver)
+	for name, list := range cfg.Upstreams {
+		addresses, err := parseAddresses(config.List(list))
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", name, err)
+		}
+		upstream, err := newResolver(cfg, "UPSTREAM "+strings.ToUpper(name), addresses)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", name, err)
+		}
+		upstreams[name] = upstream
+	}
+	var routes []proxy.Route
+	for zone, name := range cfg.Forwards {
+		upstream, ok := upstreams[name]
+		if !ok {
+			return nil, fmt.Errorf("zone %s: unknown upstream %s", zone, name)
+		}
+		routes = append(routes, proxy.Route{Zone: zone, Resolver: upstream})
+	}
+	return routes, nil
+}
+
+func parseAddresses(list []string) ([]resolver.Address, error) {
+	var addresses []resolver.Address
+	for _, item := range list {
+		address, err := resolver.ParseAddress(item)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
@@ -1,11 +1,13 @@
 module dns-proxy
 
-go 1.17
+go 1.26.0
 
 require (
 	github.com/gin-gonic/gin v1.7.7
 	github.com/kelseyhightower/envconfig v1.4.0
-	golang.org/x/net v0.0.0-20220127200216-cd36cc0744dd
+	github.com/quic-go/quic-go v0.63.0
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/net v0.56.0
 )
 
 require (
@@ -20,7 +22,7 @@ require (
 	github.com/modern-go/concurrent v0.0.0-20180228061459-e0a39a4cb421 // indirect
 	github.com/modern-go/reflect2 v0.0.0-20180701023420-4b7aa43c6742 // indirect
 	github.com/ugorji/go/codec v1.1.7 // indirect
-	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
-	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
+	golang.org/x/crypto v0.54.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
 	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
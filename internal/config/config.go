@@ -1,16 +1,121 @@
 package config
 
-import "github.com/kelseyhightower/envconfig"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kelseyhightower/envconfig"
+)
 
 type Config struct {
 	TCPMaxConnPool  int
 	UDPMaxQueueSize int
 	CacheEnabled    bool
-	CacheTTL        int
+	// CacheTTL is the maximum time in seconds an answer is cached, whatever the TTL of its records. 0 doesn't
+	// limit it.
+	CacheTTL int
+	// CacheMinTTL is the minimum time in seconds an answer is cached, even if its records have lower TTLs.
+	CacheMinTTL int
+	// CacheMaxNegativeTTL is the maximum time in seconds NXDOMAIN and NODATA answers are cached. 0 doesn't
+	// limit it.
+	CacheMaxNegativeTTL int `default:"3600"`
+	// CacheStaleWindow is how long, in seconds, expired answers are kept to be served with a TTL of
+	// CacheStaleTTL when the resolver fails or takes longer than CacheStaleTimeOut milliseconds (RFC 8767).
+	// 0 doesn't serve stale answers, and a 0 timeout waits for the resolver. Once the resolver fails for a
+	// question, its stale answer is served for CacheStaleRecheck seconds without trying it again, 0 to try
+	// it on every query.
+	CacheStaleWindow  int `default:"86400"`
+	CacheStaleTTL     int `default:"30"`
+	CacheStaleTimeOut int `default:"1800"`
+	CacheStaleRecheck int `default:"30"`
+	// CachePrefetchHits is the number of hits that makes an answer popular enough to be refreshed before it
+	// expires. 0 doesn't prefetch.
+	CachePrefetchHits int `default:"3"`
+	// CacheEviction is the policy evicting answers when the cache is full: lru, lfu or tinylfu.
+	CacheEviction string `default:"lru"`
+	// CacheMaxEntries and CacheMaxBytes limit the number of answers cached and the approximate memory they
+	// take. 0 doesn't limit them.
+	CacheMaxEntries int `default:"100000"`
+	CacheMaxBytes   int
+	// CacheShards is the number of parts the cache is split in, each with its own lock. 0 sets a few per CPU.
+	CacheShards     int
 	ResolverTimeOut uint
-	ProviderHost    string
-	ProviderPort    int
-	Port            int
+	// ResolverPoolSize is the maximum number of connections to the DNS Provider. Each one carries many queries.
+	ResolverPoolSize int `default:"8"`
+	// ResolverIdleTimeOut is the time in milliseconds an idle connection is kept open.
+	ResolverIdleTimeOut uint `default:"30000"`
+	ProviderHost        string
+	ProviderPort        int
+	// ProviderServerName is the name the certificate of the DNS Provider is verified against, like
+	// 'cloudflare-dns.com' for 1.1.1.1. Defaults to ProviderHost.
+	ProviderServerName string
+	// ProviderCAFile is a PEM bundle of the CAs trusted for the DNS Provider. Defaults to the system roots.
+	ProviderCAFile string
+	// ProviderPins are the base64 SHA-256 SPKI hashes one of the certificates of the DNS Provider must match.
+	ProviderPins []string
+	// Providers are the addresses of several DNS Providers, like 'tls://1.1.1.1?name=cloudflare-dns.com'.
+	// When set, ProviderHost, ProviderPort, ProviderServerName and ProviderPins are ignored.
+	Providers []string
+	// ProviderStrategy is the order the Providers are tried in: strict, round-robin, random or fastest.
+	ProviderStrategy string `default:"strict"`
+	// ProviderMaxFails is the number of consecutive failures that ejects a provider.
+	ProviderMaxFails int `default:"3"`
+	// ProviderProbeInterval is the time in seconds between health probes of the providers.
+	ProviderProbeInterval int `default:"10"`
+	// Upstreams are named groups of DNS servers other than the Providers, as 'name=address;address' pairs.
+	// The addresses are written like the ones of Providers, like 'udp://10.0.0.53'.
+	Upstreams KeyValues
+	// Forwards send the queries for zones to Upstreams, as 'zone=name' pairs like 'mycompany.net=internal'.
+	Forwards      KeyValues
+	Port          int
+	BlockMode     string `default:"nxdomain"`
+	BlockSinkhole []string
+	DatabasePath  string
+	// Blocklists are the lists imported into the denylist, as 'name=location' pairs. The location is a
+	// file path or an HTTP URL.
+	Blocklists KeyValues
+	// BlocklistsRefresh is the time in minutes between imports of the blocklists.
+	BlocklistsRefresh int `default:"1440"`
+	// Groups bind the networks of the clients to policy groups, as 'name=cidr;cidr' pairs.
+	Groups KeyValues
+	// GroupDenylists and GroupAllowlists bind the policy groups to the sources of the entries applied to their
+	// clients, as 'name=list;list' pairs. Groups without lists apply every entry.
+	GroupDenylists  KeyValues
+	GroupAllowlists KeyValues
+	// GroupSchedules limit the denylists of the policy groups to a weekly window, as 'name=days window'
+	// pairs like 'kids=mon-fri 09:00-17:00'. Times are read in the timezone set with the TZ variable.
+	GroupSchedules KeyValues
+}
+
+// KeyValues is a map read from 'key=value' pairs separated by commas. Unlike the maps of envconfig, the
+// values can contain colons, like the ones of URLs.
+type KeyValues map[string]string
+
+func (kv *KeyValues) Decode(value string) error {
+	m := KeyValues{}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kvpair := strings.SplitN(pair, "=", 2)
+		if len(kvpair) != 2 || kvpair[0] == "" {
+			return fmt.Errorf("invalid key=value pair: %q", pair)
+		}
+		m[strings.TrimSpace(kvpair[0])] = strings.TrimSpace(kvpair[1])
+	}
+	*kv = m
+	return nil
+}
+
+// List splits a value of KeyValues in its items separated by semicolons.
+func List(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ";") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 func GetConfig() (*Config, error) {
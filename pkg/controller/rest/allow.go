@@ -0,0 +1,106 @@
+package rest
+
+import (
+	"dns-proxy/pkg/domain/allowlist"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// addAllowedDomain adds the domain to the allowlist. The body is optional and can carry the 'sources' field
+// of the entry.
+func addAllowedDomain(svc allowlist.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		domain := c.Param("domain")
+		if domain == "" {
+			c.JSON(http.StatusBadRequest, newJSONError(errors.New("missing domain")))
+			return
+		}
+		var allowed allowlist.Allowed
+		if err := c.ShouldBindJSON(&allowed); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, newJSONError(err))
+			return
+		}
+		allowed.Domain = domain
+		err := svc.AddAllowedDomain(allowed)
+		if err != nil {
+			c.JSON(statusFor(err), newJSONError(err))
+			return
+		}
+		c.JSON(http.StatusOK, newJSONMessage(fmt.Sprintf("%s added to allowlist successfully", domain)))
+	}
+}
+
+// addAllowedDomains adds all the entries of the JSON array in the body to the allowlist.
+func addAllowedDomains(svc allowlist.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var allowed []allowlist.Allowed
+		if err := c.ShouldBindJSON(&allowed); err != nil {
+			c.JSON(http.StatusBadRequest, newJSONError(err))
+			return
+		}
+		err := svc.AddAllowedDomains(allowed)
+		if err != nil {
+			c.JSON(statusFor(err), newJSONError(err))
+			return
+		}
+		c.JSON(http.StatusOK, newJSONMessage(fmt.Sprintf("%d domains added to allowlist successfully", len(allowed))))
+	}
+}
+
+func removeAllowedDomain(svc allowlist.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		domain := c.Param("domain")
+		err := svc.RemoveAllowedDomain(domain)
+		if err != nil {
+			c.JSON(statusFor(err), newJSONError(err))
+			return
+		}
+		c.JSON(http.StatusOK, newJSONMessage(fmt.Sprintf("%s removed from allowlist successfully", domain)))
+	}
+}
+
+func getAllowedDomain(svc allowlist.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		domain := c.Param("domain")
+		allowed, err := svc.GetAllowedDomain(domain)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, newJSONError(err))
+			return
+		}
+		if allowed == nil {
+			c.JSON(http.StatusNotFound, newJSONError(allowlist.ErrNotFound))
+			return
+		}
+		c.JSON(http.StatusOK, allowed)
+	}
+}
+
+// getAllowedDomains lists the allowlist sorted by domain. The page is selected with the 'offset' and 'limit'
+// query parameters.
+func getAllowedDomains(svc allowlist.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		offset, limit, err := page(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, newJSONError(err))
+			return
+		}
+		allowed, err := svc.GetAllowedDomains()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, newJSONError(err))
+			return
+		}
+		sort.Slice(allowed, func(i, j int) bool { return allowed[i].Domain < allowed[j].Domain })
+		start, end := bounds(offset, limit, len(allowed))
+		c.JSON(http.StatusOK, gin.H{
+			"total":   len(allowed),
+			"offset":  start,
+			"limit":   limit,
+			"domains": allowed[start:end],
+		})
+	}
+}
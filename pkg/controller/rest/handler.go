@@ -1,18 +1,41 @@
 package rest
 
 import (
+	"dns-proxy/pkg/domain/allowlist"
 	"dns-proxy/pkg/domain/denylist"
+	"dns-proxy/pkg/domain/proxy"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-func Handler(denySvc denylist.Service) *gin.Engine {
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+func Handler(denySvc denylist.Service, allowSvc allowlist.Service, cache proxy.Cache) *gin.Engine {
 	router := gin.New()
+	// Regex rules contain slashes, so they are sent escaped and unescaped once the route is matched.
+	router.UseRawPath = true
 	router.GET("ping", ping)
-	//router.PUT("/deny/:domain", addDeniedDomain(denySvc))
+	router.GET("/deny", getDeniedDomains(denySvc))
+	router.POST("/deny", addDeniedDomains(denySvc))
+	router.GET("/deny/:domain", getDeniedDomain(denySvc))
+	router.PUT("/deny/:domain", addDeniedDomain(denySvc))
+	router.DELETE("/deny/:domain", removeDeniedDomain(denySvc))
+	router.GET("/allow", getAllowedDomains(allowSvc))
+	router.POST("/allow", addAllowedDomains(allowSvc))
+	router.GET("/allow/:domain", getAllowedDomain(allowSvc))
+	router.PUT("/allow/:domain", addAllowedDomain(allowSvc))
+	router.DELETE("/allow/:domain", removeAllowedDomain(allowSvc))
+	router.GET("/cache/stats", getCacheStats(cache))
 	return router
 }
 
@@ -20,6 +43,14 @@ func ping(c *gin.Context) {
 	c.String(http.StatusOK, "pong")
 }
 
+func getCacheStats(cache proxy.Cache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, cache.Stats())
+	}
+}
+
+// addDeniedDomain adds the domain to the denylist. The body is optional and can carry the fields of the entry.
+// The 'ttl' query parameter adds a temporary entry that is deleted after that number of seconds.
 func addDeniedDomain(svc denylist.Service) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		domain := c.Param("domain")
@@ -27,9 +58,23 @@ func addDeniedDomain(svc denylist.Service) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, newJSONError(errors.New("missing domain")))
 			return
 		}
-		err := svc.AddDeniedDomain(domain)
+		var denied denylist.Denied
+		if err := c.ShouldBindJSON(&denied); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, newJSONError(err))
+			return
+		}
+		ttl, err := queryInt(c, "ttl", 0)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, newJSONError(err))
+			c.JSON(http.StatusBadRequest, newJSONError(err))
+			return
+		}
+		if ttl > 0 {
+			denied.Expires = time.Now().Add(time.Duration(ttl) * time.Second)
+		}
+		denied.Domain = domain
+		err = svc.AddDeniedDomain(denied)
+		if err != nil {
+			c.JSON(statusFor(err), newJSONError(err))
 			return
 		}
 		c.JSON(http.StatusOK, newJSONMessage(fmt.Sprintf("%s added to denylist successfully", domain)))
@@ -37,6 +82,129 @@ func addDeniedDomain(svc denylist.Service) gin.HandlerFunc {
 	}
 }
 
+// addDeniedDomains adds all the entries of the JSON array in the body to the denylist.
+func addDeniedDomains(svc denylist.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var denied []denylist.Denied
+		if err := c.ShouldBindJSON(&denied); err != nil {
+			c.JSON(http.StatusBadRequest, newJSONError(err))
+			return
+		}
+		err := svc.AddDeniedDomains(denied)
+		if err != nil {
+			c.JSON(statusFor(err), newJSONError(err))
+			return
+		}
+		c.JSON(http.StatusOK, newJSONMessage(fmt.Sprintf("%d domains added to denylist successfully", len(denied))))
+	}
+}
+
+func removeDeniedDomain(svc denylist.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		domain := c.Param("domain")
+		err := svc.RemoveDeniedDomain(domain)
+		if err != nil {
+			c.JSON(statusFor(err), newJSONError(err))
+			return
+		}
+		c.JSON(http.StatusOK, newJSONMessage(fmt.Sprintf("%s removed from denylist successfully", domain)))
+	}
+}
+
+func getDeniedDomain(svc denylist.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		domain := c.Param("domain")
+		denied, err := svc.GetDeniedDomain(domain)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, newJSONError(err))
+			return
+		}
+		if denied == nil {
+			c.JSON(http.StatusNotFound, newJSONError(denylist.ErrNotFound))
+			return
+		}
+		c.JSON(http.StatusOK, denied)
+	}
+}
+
+// getDeniedDomains lists the denylist sorted by domain. The page is selected with the 'offset' and 'limit'
+// query parameters.
+func getDeniedDomains(svc denylist.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		offset, limit, err := page(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, newJSONError(err))
+			return
+		}
+		denied, err := svc.GetDeniedDomains()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, newJSONError(err))
+			return
+		}
+		sort.Slice(denied, func(i, j int) bool { return denied[i].Domain < denied[j].Domain })
+		start, end := bounds(offset, limit, len(denied))
+		c.JSON(http.StatusOK, gin.H{
+			"total":   len(denied),
+			"offset":  start,
+			"limit":   limit,
+			"domains": denied[start:end],
+		})
+	}
+}
+
+// page reads the 'offset' and 'limit' query parameters of paginated lists.
+func page(c *gin.Context) (int, int, error) {
+	offset, err := queryInt(c, "offset", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	limit, err := queryInt(c, "limit", defaultPageLimit)
+	if err != nil {
+		return 0, 0, err
+	}
+	if limit == 0 || limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	return offset, limit, nil
+}
+
+// bounds returns the indexes of the page within a list of total items.
+func bounds(offset, limit, total int) (int, int) {
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return offset, end
+}
+
+// queryInt reads a non negative integer query parameter, returning def if it's missing.
+func queryInt(c *gin.Context, name string, def int) (int, error) {
+	value := c.Query(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return n, nil
+}
+
+// statusFor maps the errors of the denylist and allowlist services to HTTP status codes.
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, denylist.ErrNotFound), errors.Is(err, allowlist.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, denylist.ErrMissingDomain), errors.Is(err, denylist.ErrInvalidEntry),
+		errors.Is(err, allowlist.ErrMissingDomain), errors.Is(err, allowlist.ErrInvalidEntry):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
 func newJSONError(err error) map[string]string {
 	jsonError := make(map[string]string)
 	jsonError["error"] = fmt.Sprintf("%v", err)
@@ -1,17 +1,27 @@
 package tcp
 
 import (
+	"bufio"
 	"dns-proxy/pkg/domain/proxy"
+	"errors"
+	"io"
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
+)
+
+const (
+	// idleTimeOut is the time a connection is kept open waiting for the next query.
+	idleTimeOut = 10 * time.Second
+	// maxPipelined is the number of queries of a connection resolved at once.
+	maxPipelined = 32
 )
 
 // NewTCPHandler returns a TCPHandler
-func NewTCPHandler(packetSize int, logger Logger, cache proxy.Cache, parser proxy.DNSParser) *TCPHandler {
+func NewTCPHandler(packetSize int, parser proxy.DNSParser, logger Logger) *TCPHandler {
 	return &TCPHandler{
 		log:    logger,
-		cache:  cache,
 		parser: parser,
 		bufferPool: sync.Pool{
 			New: func() interface{} {
@@ -24,70 +34,55 @@ func NewTCPHandler(packetSize int, logger Logger, cache proxy.Cache, parser prox
 // TCPHandler has the attributes required for managing the TCP connections, the bufferPool needed to read messages from the requests and things like logger.
 type TCPHandler struct {
 	log        Logger
-	bufferPool sync.Pool
-	cache      proxy.Cache
 	parser     proxy.DNSParser
+	bufferPool sync.Pool
 }
 
-// HandleTCPConnection reads a message from the server and execute the DNS resolution calling the Proxy service.
+// HandleTCPConnection reads the messages of the connection and executes their DNS resolution calling the Proxy
+// service. Clients can send many queries on the same connection without waiting for the responses, as
+// RFC 7766 allows, so they are resolved at once and the responses written as they are ready, in any order.
+// The connection is closed once it's idle for idleTimeOut.
+// The address of the client is passed to the Proxy to apply the policy of its group.
 func (d *TCPHandler) HandleTCPConnection(conn *net.Conn, p proxy.Service) {
-	// TODO: This first block of code that is reading the TCP socket can be moved to a different function.
 	defer (*conn).Close()
-	msg := d.bufferPool.Get().([]byte)
-	nbytes, err := (*conn).Read(msg[:])
-	if err != nil {
-		d.log.Err("%v", err)
-	}
+	// After writing the responses the connection is deducted from the connections counter.
+	defer atomic.AddUint64(&connections, ^uint64(0))
 
-	// Look for message in the cache before resolve it.
-	cachedMessage, err := d.GetRecordFromCache(msg)
-	if cachedMessage != nil {
-		(*conn).Write(cachedMessage)
-		atomic.AddUint64(&connections, ^uint64(0))
-		return
-	}
-
-	// if cachedMessage it's empty go resolve the DNS.
-	response, err := p.SolveTCP(msg[:nbytes])
-	if err != nil {
-		d.log.Err("%v", err)
-	}
-	(*conn).Write(response)
-	// After writing the response the connection is deducted from the connections counter.
-	atomic.AddUint64(&connections, ^uint64(0))
-
-	// Once we write the response to the client save the record in the cache.
-	if d.StoreRecordInCache(response) != nil {
-		d.log.Err("%v", err)
-	}
-}
-
-func (h *TCPHandler) StoreRecordInCache(msg []byte) error {
-	dnsmessage, err := h.parser.TCPMsgToDNS(msg)
-	if err != nil {
-		return err
-	}
-	if h.cache.Store(*dnsmessage) != nil {
-		return err
-	}
-	return nil
-}
-
-func (h *TCPHandler) GetRecordFromCache(msg []byte) ([]byte, error) {
-	dnsmessage, _ := h.parser.TCPMsgToDNS(msg)
-	cachedMessage, err := h.cache.Get(*dnsmessage)
-	if err != nil {
-		h.log.Err("Cache error: %v", err)
-	}
-	if cachedMessage != nil {
-		h.log.Debug("Message found in cache")
-		cachedMessage.Header.ID = dnsmessage.Header.ID
-		// Message from cache returns as 'dnsmessage'. Parse to 'raw' to return.
-		cachedMessageRaw, err := h.parser.DNSToMsg(cachedMessage, proxy.SocketTCP)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var writeMx sync.Mutex
+	pipelined := make(chan struct{}, maxPipelined)
+	reader := bufio.NewReader(*conn)
+	for {
+		if err := (*conn).SetReadDeadline(time.Now().Add(idleTimeOut)); err != nil {
+			d.log.Err("%v", err)
+			return
+		}
+		msg, err := d.parser.ReadTCPMsg(reader, d.bufferPool.Get().([]byte))
 		if err != nil {
-			return nil, err
+			var netErr net.Error
+			if !errors.Is(err, io.EOF) && !(errors.As(err, &netErr) && netErr.Timeout()) {
+				d.log.Err("%v", err)
+			}
+			return
 		}
-		return cachedMessageRaw, nil
+
+		pipelined <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-pipelined }()
+			defer d.bufferPool.Put(msg[:cap(msg)])
+			response, err := p.SolveTCP(msg, (*conn).RemoteAddr())
+			if err != nil {
+				d.log.Err("%v", err)
+				return
+			}
+			writeMx.Lock()
+			defer writeMx.Unlock()
+			if _, err := (*conn).Write(response); err != nil {
+				d.log.Err("%v", err)
+			}
+		}()
 	}
-	return nil, nil
 }
@@ -9,8 +9,6 @@ import (
 
 // UDPHandler has the attributes required for managing the UDP message queue, the bufferPool needed to read messages from the requests and things like logger.
 type UDPHandler struct {
-	cache        proxy.Cache
-	parser       proxy.DNSParser
 	log          Logger
 	maxQueueSize int
 	messageQueue chan message
@@ -27,10 +25,8 @@ type message struct {
 }
 
 // NewUDPHandler returns a UDPHandler
-func NewUDPHandler(packetSize, maxQueueSize int, logger Logger, cache proxy.Cache, parser proxy.DNSParser) *UDPHandler {
+func NewUDPHandler(packetSize, maxQueueSize int, logger Logger) *UDPHandler {
 	return &UDPHandler{
-		parser:       parser,
-		cache:        cache,
 		log:          logger,
 		maxQueueSize: maxQueueSize,
 		messageQueue: make(chan message, maxQueueSize),
@@ -42,63 +38,21 @@ func NewUDPHandler(packetSize, maxQueueSize int, logger Logger, cache proxy.Cach
 }
 
 // handleMessage receives a message from the queue and execute the DNS resolution calling the Proxy service.
+// The address of the client is passed to the Proxy to apply the policy of its group.
 func (u *UDPHandler) handleMessage(c net.PacketConn, m *message, p proxy.Service) {
-	// Look for message in the cache before resolve it.
-	cachedMessage, err := u.GetRecordFromCache(m.msg)
-	if cachedMessage != nil {
-		_, err = c.WriteTo(cachedMessage[:], m.addr)
-		if err != nil {
-			u.log.Err("%v", err)
-		}
-		return
-	}
-	// if cachedMessage it's empty go resolve the DNS.
-	response, err := p.SolveUDP(m.msg)
+	response, err := p.SolveUDP(m.msg[:m.length], m.addr)
 	if err != nil {
 		u.log.Err("%v", err)
+		return
 	}
 	_, err = c.WriteTo(response[:], m.addr)
 	if err != nil {
 		u.log.Err("%v", err)
 	}
-	// Once the response is written to the client save the record in memory cache.
-	if u.StoreRecordInCache(response) != nil {
-		u.log.Err("%v", err)
-	}
 
 	atomic.AddUint64(&ops, 1)
 }
 
-func (u *UDPHandler) StoreRecordInCache(msg []byte) error {
-	dnsmessage, err := u.parser.UDPMsgToDNS(msg)
-	if err != nil {
-		return err
-	}
-	if u.cache.Store(*dnsmessage) != nil {
-		return err
-	}
-	return nil
-}
-
-func (u *UDPHandler) GetRecordFromCache(msg []byte) ([]byte, error) {
-	dnsmessage, _ := u.parser.UDPMsgToDNS(msg)
-	cachedMessage, err := u.cache.Get(*dnsmessage)
-	if err != nil {
-		u.log.Err("Cache error: %v", err)
-	}
-	if cachedMessage != nil {
-		u.log.Debug("Message found in cache")
-		cachedMessage.Header.ID = dnsmessage.Header.ID
-		// Message from cache returns as 'dnsmessage'. Parse to 'raw' to return.
-		cachedMessageRaw, err := u.parser.DNSToMsg(cachedMessage, proxy.SocketUDP)
-		if err != nil {
-			return nil, err
-		}
-		return cachedMessageRaw, nil
-	}
-	return nil, nil
-}
-
 // Dequeue gets the message from the queue and send them to the handler to get the job done.
 func (u *UDPHandler) Dequeue(p proxy.Service) {
 	for m := range u.messageQueue {
@@ -0,0 +1,176 @@
+package allowlist
+
+import (
+	"dns-proxy/pkg/domain/matcher"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrMissingDomain is returned when an entry is added without domain.
+var ErrMissingDomain = errors.New("missing domain")
+
+// ErrInvalidEntry is wrapped by the errors of entries with invalid fields.
+var ErrInvalidEntry = errors.New("invalid allowlist entry")
+
+// ErrNotFound is returned when removing a domain that is not in the allowlist.
+var ErrNotFound = errors.New("domain not found in allowlist")
+
+// Service the contains the methods for the domain layer.
+type Service interface {
+	AddAllowedDomain(Allowed) error
+	AddAllowedDomains([]Allowed) error
+	RemoveAllowedDomain(string) error
+	GetAllowedDomain(string) (*Allowed, error)
+	GetAllowedDomains() ([]Allowed, error)
+	MatchAllowedDomain(string, []string) (*Allowed, error)
+}
+
+// Repository contains the methods for the Repository/Storage layer. It will be embedded within the service struct.
+// RemoveAllowedDomain returns ErrNotFound if the domain is not stored.
+type Repository interface {
+	AddAllowedDomain(Allowed) error
+	AddAllowedDomains([]Allowed) error
+	RemoveAllowedDomain(string) error
+	GetAllowedDomain(string) (*Allowed, error)
+	GetAllowedDomains() ([]Allowed, error)
+}
+
+// Allowed is an entry of the allowlist. Domain is a rule with the same syntax as the denylist ones, except networks.
+// A domain matching an allowlist rule is always resolved, even if it matches a denylist rule.
+// Sources are the names of the allowlists the entry belongs to. Entries without sources apply to every client.
+type Allowed struct {
+	Domain  string    `json:"domain"`
+	Date    time.Time `json:"date,omitempty"`
+	Sources []string  `json:"sources,omitempty"`
+}
+
+// service implements the Service interface. Also composes the Repository interface.
+// The rules are indexed in memory to match the domains without going through the database.
+type service struct {
+	database Repository
+	index    *matcher.Matcher
+}
+
+// NewService loads the rules stored in the repository into the index.
+func NewService(db Repository) (Service, error) {
+	s := &service{database: db, index: matcher.New()}
+	allowed, err := db.GetAllowedDomains()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range allowed {
+		if err := s.index.Add(a.Domain); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *service) AddAllowedDomain(allowed Allowed) error {
+	allowed, err := prepare(allowed)
+	if err != nil {
+		return err
+	}
+	err = s.database.AddAllowedDomain(allowed)
+	if err != nil {
+		return err
+	}
+	return s.index.Add(allowed.Domain)
+}
+
+// AddAllowedDomains validates all the entries before storing them, so an invalid entry doesn't leave the
+// allowlist half updated.
+func (s *service) AddAllowedDomains(allowed []Allowed) error {
+	entries := make([]Allowed, 0, len(allowed))
+	for i, a := range allowed {
+		entry, err := prepare(a)
+		if err != nil {
+			return fmt.Errorf("entry %d: %w", i, err)
+		}
+		entries = append(entries, entry)
+	}
+	err := s.database.AddAllowedDomains(entries)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := s.index.Add(entry.Domain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *service) RemoveAllowedDomain(domain string) error {
+	domain = matcher.Normalize(domain)
+	err := s.database.RemoveAllowedDomain(domain)
+	if err != nil {
+		return err
+	}
+	s.index.Remove(domain)
+	return nil
+}
+
+// GetAllowedDomain returns the entry of the most specific rule matching the domain. Wildcard, suffix and regex
+// rules are returned as they are instead of being matched, so they can be looked up by the API.
+func (s *service) GetAllowedDomain(domain string) (*Allowed, error) {
+	domain = matcher.Normalize(domain)
+	if rule, err := matcher.Parse(domain); err != nil || rule.Kind == matcher.Exact {
+		return s.MatchAllowedDomain(domain, nil)
+	}
+	response, err := s.database.GetAllowedDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+	if response == nil {
+		return nil, nil
+	}
+	return response, nil
+}
+
+// MatchAllowedDomain returns the entry of the most specific rule matching the domain that applies to the lists.
+// Entries without sources apply to every list, and nil lists accept every entry.
+func (s *service) MatchAllowedDomain(domain string, lists []string) (*Allowed, error) {
+	var allowed *Allowed
+	var err error
+	_, ok := s.index.MatchFunc(matcher.Normalize(domain), func(rule string) bool {
+		allowed, err = s.database.GetAllowedDomain(rule)
+		return err != nil || (allowed != nil && matcher.InLists(allowed.Sources, lists))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+	return allowed, nil
+}
+
+func (s *service) GetAllowedDomains() ([]Allowed, error) {
+	response, err := s.database.GetAllowedDomains()
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// prepare normalizes and validates an entry before it's stored.
+func prepare(allowed Allowed) (Allowed, error) {
+	allowed.Domain = matcher.Normalize(allowed.Domain)
+	if allowed.Domain == "" {
+		return allowed, ErrMissingDomain
+	}
+	rule, err := matcher.Parse(allowed.Domain)
+	if err != nil {
+		return allowed, fmt.Errorf("%w: %v", ErrInvalidEntry, err)
+	}
+	if rule.Kind == matcher.Network {
+		// Allowed questions aren't checked against the network rules, so they can't be allowed.
+		return allowed, fmt.Errorf("%w: network rules aren't supported", ErrInvalidEntry)
+	}
+	if allowed.Date.IsZero() {
+		allowed.Date = time.Now()
+	}
+	return allowed, nil
+}
@@ -0,0 +1,27 @@
+package allowlist_test
+
+import (
+	"dns-proxy/pkg/domain/allowlist"
+	"dns-proxy/pkg/gateway/repository"
+	"errors"
+	"testing"
+)
+
+// Network rules are rejected since allowed questions are never matched against them.
+func TestAddAllowedDomainNetwork(t *testing.T) {
+	svc, err := allowlist.NewService(repository.NewMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, domain := range []string{"10.0.0.0/8", "2001:db8::1"} {
+		if err := svc.AddAllowedDomain(allowlist.Allowed{Domain: domain}); !errors.Is(err, allowlist.ErrInvalidEntry) {
+			t.Errorf("AddAllowedDomain(%q) = %v, want ErrInvalidEntry", domain, err)
+		}
+		if err := svc.AddAllowedDomains([]allowlist.Allowed{{Domain: domain}}); !errors.Is(err, allowlist.ErrInvalidEntry) {
+			t.Errorf("AddAllowedDomains(%q) = %v, want ErrInvalidEntry", domain, err)
+		}
+	}
+	if err := svc.AddAllowedDomain(allowlist.Allowed{Domain: "||example.com^"}); err != nil {
+		t.Errorf("AddAllowedDomain(||example.com^) = %v", err)
+	}
+}
@@ -0,0 +1,8 @@
+package denylist
+
+import "time"
+
+// FlushAt removes the entries of s expired at now, like Flush does every minute.
+func FlushAt(s Service, now time.Time) error {
+	return s.(*service).flush(now)
+}
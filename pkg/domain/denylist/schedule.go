@@ -0,0 +1,177 @@
+package denylist
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Schedule is a weekly time window. Days are weekday names like 'mon', and every day is included when there
+// are none. From and To are 'HH:MM' times; a window where To is before From ends the next day, and an empty
+// window lasts the whole day. Times are read in Timezone, an IANA name like 'Europe/Berlin', or in the local
+// timezone of the proxy, set with the TZ environment variable, if it's empty.
+type Schedule struct {
+	Days     []string `json:"days,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       string   `json:"to,omitempty"`
+	Timezone string   `json:"timezone,omitempty"`
+}
+
+// ParseSchedule reads a schedule written as days and window separated by a space, like 'mon-fri 09:00-17:00'
+// or 'sat;sun'. Days are a range or a list separated by semicolons.
+func ParseSchedule(value string) (*Schedule, error) {
+	var schedule Schedule
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("%w: invalid schedule %q", ErrInvalidEntry, value)
+	}
+	days := fields[0]
+	if from, to, ok := cut(days, "-"); ok {
+		first, okFrom := weekdays[strings.ToLower(from)]
+		last, okTo := weekdays[strings.ToLower(to)]
+		if !okFrom || !okTo {
+			return nil, fmt.Errorf("%w: invalid days %q", ErrInvalidEntry, days)
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			schedule.Days = append(schedule.Days, dayName(d))
+			if d == last {
+				break
+			}
+		}
+	} else {
+		schedule.Days = strings.Split(days, ";")
+	}
+	if len(fields) == 2 {
+		from, to, ok := cut(fields[1], "-")
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid schedule window %q", ErrInvalidEntry, fields[1])
+		}
+		schedule.From, schedule.To = from, to
+	}
+	if err := schedule.Validate(); err != nil {
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+// Validate checks the days, times and timezone of the schedule.
+func (s *Schedule) Validate() error {
+	for _, day := range s.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("%w: invalid day %q", ErrInvalidEntry, day)
+		}
+	}
+	if (s.From == "") != (s.To == "") {
+		return fmt.Errorf("%w: schedule needs both from and to", ErrInvalidEntry)
+	}
+	for _, clock := range []string{s.From, s.To} {
+		if _, err := minutes(clock); err != nil {
+			return fmt.Errorf("%w: invalid time %q", ErrInvalidEntry, clock)
+		}
+	}
+	if _, err := location(s.Timezone); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEntry, err)
+	}
+	return nil
+}
+
+// Active reports whether t falls within the schedule.
+func (s *Schedule) Active(t time.Time) bool {
+	loc, err := location(s.Timezone)
+	if err != nil {
+		return false
+	}
+	t = t.In(loc)
+	from, _ := minutes(s.From)
+	to, _ := minutes(s.To)
+	now := t.Hour()*60 + t.Minute()
+	switch {
+	case from == to:
+		return s.onDay(t.Weekday())
+	case from < to:
+		return s.onDay(t.Weekday()) && now >= from && now < to
+	case now >= from:
+		return s.onDay(t.Weekday())
+	case now < to:
+		// The window started the day before.
+		return s.onDay((t.Weekday() + 6) % 7)
+	}
+	return false
+}
+
+func (s *Schedule) onDay(day time.Weekday) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, d := range s.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// minutes returns the minutes since midnight of a 'HH:MM' time. An empty time is midnight.
+func minutes(clock string) (int, error) {
+	if clock == "" {
+		return 0, nil
+	}
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+var (
+	locationsMx sync.RWMutex
+	locations   = map[string]*time.Location{}
+)
+
+// location loads the timezone once and keeps it for the next lookups.
+func location(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	locationsMx.RLock()
+	loc, ok := locations[name]
+	locationsMx.RUnlock()
+	if ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locationsMx.Lock()
+	locations[name] = loc
+	locationsMx.Unlock()
+	return loc, nil
+}
+
+func dayName(day time.Weekday) string {
+	for name, d := range weekdays {
+		if d == day {
+			return name
+		}
+	}
+	return ""
+}
+
+func cut(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
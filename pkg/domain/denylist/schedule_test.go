@@ -0,0 +1,95 @@
+package denylist_test
+
+import (
+	"dns-proxy/pkg/domain/denylist"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		value string
+		want  *denylist.Schedule
+	}{
+		{value: "mon-fri 09:00-17:00", want: &denylist.Schedule{Days: []string{"mon", "tue", "wed", "thu", "fri"}, From: "09:00", To: "17:00"}},
+		{value: "fri-mon", want: &denylist.Schedule{Days: []string{"fri", "sat", "sun", "mon"}}},
+		{value: "sat;sun 22:00-06:00", want: &denylist.Schedule{Days: []string{"sat", "sun"}, From: "22:00", To: "06:00"}},
+		{value: ""},
+		{value: "fri-funday"},
+		{value: "mon;someday"},
+		{value: "mon 09:00"},
+		{value: "mon 9am-5pm"},
+		{value: "mon 09:00-17:00 UTC"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := denylist.ParseSchedule(tt.value)
+			if tt.want == nil {
+				if !errors.Is(err, denylist.ErrInvalidEntry) {
+					t.Fatalf("ParseSchedule(%q) = %+v, %v, want ErrInvalidEntry", tt.value, got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseSchedule(%q) = %+v, want %+v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTimezone(t *testing.T) {
+	schedule := denylist.Schedule{Timezone: "Mars/Olympus_Mons"}
+	if err := schedule.Validate(); !errors.Is(err, denylist.ErrInvalidEntry) {
+		t.Errorf("Validate() = %v, want ErrInvalidEntry", err)
+	}
+}
+
+func TestActive(t *testing.T) {
+	// 2026-01-02 is a Friday.
+	at := func(day, hour int) time.Time { return time.Date(2026, time.January, day, hour, 0, 0, 0, time.UTC) }
+	overnight := &denylist.Schedule{Days: []string{"fri"}, From: "22:00", To: "06:00", Timezone: "UTC"}
+	weekend, err := denylist.ParseSchedule("fri-mon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	weekend.Timezone = "UTC"
+	office := &denylist.Schedule{Days: []string{"mon"}, From: "09:00", To: "17:00", Timezone: "America/New_York"}
+	sunday := &denylist.Schedule{Days: []string{"sun"}, Timezone: "America/New_York"}
+	tests := []struct {
+		name     string
+		schedule *denylist.Schedule
+		t        time.Time
+		want     bool
+	}{
+		{name: "overnight friday night", schedule: overnight, t: at(2, 23), want: true},
+		{name: "overnight saturday morning", schedule: overnight, t: at(3, 3), want: true},
+		{name: "overnight saturday end", schedule: overnight, t: at(3, 6)},
+		{name: "overnight friday morning", schedule: overnight, t: at(2, 3)},
+		{name: "overnight friday afternoon", schedule: overnight, t: at(2, 12)},
+		{name: "overnight saturday night", schedule: overnight, t: at(3, 23)},
+		{name: "wrapping sunday", schedule: weekend, t: at(4, 12), want: true},
+		{name: "wrapping monday", schedule: weekend, t: at(5, 12), want: true},
+		{name: "wrapping tuesday", schedule: weekend, t: at(6, 12)},
+		{name: "wrapping thursday", schedule: weekend, t: at(1, 12)},
+		// 15:00 UTC is 10:00 in New York and 13:00 UTC is 08:00.
+		{name: "timezone in window", schedule: office, t: at(5, 15), want: true},
+		{name: "timezone before window", schedule: office, t: at(5, 13)},
+		{name: "timezone after window", schedule: office, t: at(5, 22)},
+		// Monday 02:00 UTC is still Sunday in New York.
+		{name: "timezone previous day", schedule: sunday, t: at(5, 2), want: true},
+		{name: "timezone next day", schedule: sunday, t: at(5, 6)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.schedule.Active(tt.t); got != tt.want {
+				t.Errorf("Active(%v) = %v, want %v", tt.t, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,52 +1,224 @@
 package denylist
 
-import "time"
+import (
+	"dns-proxy/pkg/domain/matcher"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mode is the way the proxy answers a question for a denied domain.
+type Mode string
+
+// ModeDefault makes the entry use the mode configured globally for the proxy.
+const (
+	ModeDefault  Mode = ""
+	ModeNXDomain Mode = "nxdomain"
+	ModeNoData   Mode = "nodata"
+	ModeRefused  Mode = "refused"
+	ModeNullIP   Mode = "nullip"
+	ModeSinkhole Mode = "sinkhole"
+)
+
+// ErrMissingDomain is returned when an entry is added without domain.
+var ErrMissingDomain = errors.New("missing domain")
+
+// ErrInvalidEntry is wrapped by the errors of entries with invalid fields.
+var ErrInvalidEntry = errors.New("invalid denylist entry")
+
+// ErrNotFound is returned when removing a domain that is not in the denylist.
+var ErrNotFound = errors.New("domain not found in denylist")
 
 // Service the contains the methods for the domain layer.
 type Service interface {
-	AddDeniedDomain(string) error
+	AddDeniedDomain(Denied) error
+	AddDeniedDomains([]Denied) error
+	RemoveDeniedDomain(string) error
+	RemoveDeniedDomains([]string) error
 	GetDeniedDomain(string) (*Denied, error)
 	GetDeniedDomains() ([]Denied, error)
+	MatchDeniedDomain(string, []string) (*Denied, error)
+	MatchDeniedIP(net.IP, []string) (*Denied, error)
+	Flush()
 }
 
 // Repository contains the methods for the Repository/Storage layer. It will be embedded within the service struct.
+// RemoveDeniedDomain returns ErrNotFound if the domain is not stored.
 type Repository interface {
-	AddDeniedDomain(string) error
+	AddDeniedDomain(Denied) error
+	AddDeniedDomains([]Denied) error
+	RemoveDeniedDomain(string) error
+	RemoveDeniedDomains([]string) error
 	GetDeniedDomain(string) (*Denied, error)
 	GetDeniedDomains() ([]Denied, error)
 }
 
+// Denied is an entry of the denylist. Domain is a rule matched with the syntax of the matcher package: plain
+// domains like 'example.com', wildcards like '*.example.com', adblock style suffixes like '||example.com^',
+// regular expressions like '/^ads[0-9]*\./', or networks like '203.0.113.0/24' matching the answers.
+// Mode and Sinkhole are optional and override the proxy defaults for this domain.
+// Sources are the names of the blocklists the entry was imported from, or of the lists it was added to through
+// the API. Entries without sources apply to every client.
+// Schedule limits the blocking to a weekly time window, and temporary entries are deleted once they Expire.
 type Denied struct {
-	Domain string    `json:"domain"`
-	Date   time.Time `json:"date,omitempty"`
+	Domain   string    `json:"domain"`
+	Date     time.Time `json:"date,omitempty"`
+	Mode     Mode      `json:"mode,omitempty"`
+	Sinkhole []string  `json:"sinkhole,omitempty"`
+	Sources  []string  `json:"sources,omitempty"`
+	Schedule *Schedule `json:"schedule,omitempty"`
+	Expires  time.Time `json:"expires,omitempty"`
+}
+
+// Enforced reports whether the entry blocks its domain at the given time.
+func (d *Denied) Enforced(t time.Time) bool {
+	if !d.Expires.IsZero() && !t.Before(d.Expires) {
+		return false
+	}
+	return d.Schedule == nil || d.Schedule.Active(t)
 }
 
 // service implements the Service interface. Also composes the Repository interface.
+// The rules are indexed in memory to match the domains without going through the database, and the expiration
+// of the temporary entries is kept aside to delete them without going through the whole denylist.
 type service struct {
 	database Repository
+	index    *matcher.Matcher
+	sinkhole []string
+	// writeMx serializes the changes of the denylist, so Flush doesn't remove an entry added again with a new
+	// expiration after it found it expired.
+	writeMx  sync.Mutex
+	mx       sync.Mutex
+	expiring map[string]time.Time
+}
+
+// NewService loads the rules stored in the repository into the index. Sinkhole are the default addresses of the
+// proxy, used by the entries in sinkhole mode without their own.
+func NewService(db Repository, sinkhole []string) (Service, error) {
+	s := &service{database: db, index: matcher.New(), sinkhole: sinkhole, expiring: map[string]time.Time{}}
+	denied, err := db.GetDeniedDomains()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range denied {
+		if err := s.indexEntry(d); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *service) AddDeniedDomain(denied Denied) error {
+	denied, err := prepare(denied, s.sinkhole)
+	if err != nil {
+		return err
+	}
+	s.writeMx.Lock()
+	defer s.writeMx.Unlock()
+	err = s.database.AddDeniedDomain(denied)
+	if err != nil {
+		return err
+	}
+	return s.indexEntry(denied)
 }
 
-func NewService(db Repository) Service {
-	return &service{database: db}
+// AddDeniedDomains validates all the entries before storing them, so an invalid entry doesn't leave the
+// denylist half updated.
+func (s *service) AddDeniedDomains(denied []Denied) error {
+	entries := make([]Denied, 0, len(denied))
+	for i, d := range denied {
+		entry, err := prepare(d, s.sinkhole)
+		if err != nil {
+			return fmt.Errorf("entry %d: %w", i, err)
+		}
+		entries = append(entries, entry)
+	}
+	s.writeMx.Lock()
+	defer s.writeMx.Unlock()
+	err := s.database.AddDeniedDomains(entries)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := s.indexEntry(entry); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (s *service) AddDeniedDomain(domain string) error {
-	err := s.database.AddDeniedDomain(domain)
+func (s *service) RemoveDeniedDomain(domain string) error {
+	domain = matcher.Normalize(domain)
+	s.writeMx.Lock()
+	defer s.writeMx.Unlock()
+	err := s.database.RemoveDeniedDomain(domain)
 	if err != nil {
 		return err
 	}
+	s.unindexEntry(domain)
 	return nil
 }
 
+// RemoveDeniedDomains removes all the domains at once. Domains that are not in the denylist are ignored.
+func (s *service) RemoveDeniedDomains(domains []string) error {
+	s.writeMx.Lock()
+	defer s.writeMx.Unlock()
+	return s.removeDeniedDomains(domains)
+}
+
+func (s *service) removeDeniedDomains(domains []string) error {
+	for i := range domains {
+		domains[i] = matcher.Normalize(domains[i])
+	}
+	err := s.database.RemoveDeniedDomains(domains)
+	if err != nil {
+		return err
+	}
+	for _, domain := range domains {
+		s.unindexEntry(domain)
+	}
+	return nil
+}
+
+// GetDeniedDomain returns the entry of the most specific rule matching the domain. Wildcard, suffix and regex
+// rules are returned as they are instead of being matched, so they can be looked up by the API. Entries are
+// returned even if they aren't enforced now, like the ones out of their schedule or expired but not flushed
+// yet, so the API can show every stored entry.
 func (s *service) GetDeniedDomain(domain string) (*Denied, error) {
-	response, err := s.database.GetDeniedDomain(domain)
+	domain = matcher.Normalize(domain)
+	if rule, err := matcher.Parse(domain); err != nil || rule.Kind == matcher.Exact {
+		return s.matchDomain(domain, func(*Denied) bool { return true })
+	}
+	return s.database.GetDeniedDomain(domain)
+}
+
+// MatchDeniedDomain returns the entry of the most specific rule matching the domain that applies to the lists
+// and is enforced now. Entries without sources apply to every list, and nil lists accept every entry.
+func (s *service) MatchDeniedDomain(domain string, lists []string) (*Denied, error) {
+	now := time.Now()
+	return s.matchDomain(matcher.Normalize(domain), func(denied *Denied) bool {
+		return matcher.InLists(denied.Sources, lists) && denied.Enforced(now)
+	})
+}
+
+// matchDomain returns the entry of the most specific rule matching the domain accepted by the function.
+func (s *service) matchDomain(domain string, accept func(*Denied) bool) (*Denied, error) {
+	var denied *Denied
+	var err error
+	_, ok := s.index.MatchFunc(domain, func(rule string) bool {
+		denied, err = s.database.GetDeniedDomain(rule)
+		return err != nil || (denied != nil && accept(denied))
+	})
 	if err != nil {
 		return nil, err
 	}
-	if response == nil {
+	if !ok {
 		return nil, nil
 	}
-	return response, nil
+	return denied, nil
 }
 
 func (s *service) GetDeniedDomains() ([]Denied, error) {
@@ -56,3 +228,120 @@ func (s *service) GetDeniedDomains() ([]Denied, error) {
 	}
 	return response, nil
 }
+
+// MatchDeniedIP returns the entry of the most specific network rule containing the ip that applies to the
+// lists and is enforced now, like MatchDeniedDomain does for domains.
+func (s *service) MatchDeniedIP(ip net.IP, lists []string) (*Denied, error) {
+	var denied *Denied
+	var err error
+	now := time.Now()
+	_, ok := s.index.MatchIPFunc(ip, func(rule string) bool {
+		denied, err = s.database.GetDeniedDomain(rule)
+		return err != nil || (denied != nil && matcher.InLists(denied.Sources, lists) && denied.Enforced(now))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+	return denied, nil
+}
+
+// Flush deletes the expired entries every minute.
+func (s *service) Flush() {
+	for now := range time.Tick(time.Minute) {
+		s.flush(now)
+	}
+}
+
+// flush removes the entries expired at now. The changes of the denylist wait until they are removed, so the
+// entries found expired are still the ones removed.
+func (s *service) flush(now time.Time) error {
+	s.writeMx.Lock()
+	defer s.writeMx.Unlock()
+	var expired []string
+	s.mx.Lock()
+	for domain, expires := range s.expiring {
+		if !now.Before(expires) {
+			expired = append(expired, domain)
+		}
+	}
+	s.mx.Unlock()
+	if len(expired) == 0 {
+		return nil
+	}
+	return s.removeDeniedDomains(expired)
+}
+
+func (s *service) indexEntry(denied Denied) error {
+	if err := s.index.Add(denied.Domain); err != nil {
+		return err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if denied.Expires.IsZero() {
+		delete(s.expiring, denied.Domain)
+	} else {
+		s.expiring[denied.Domain] = denied.Expires
+	}
+	return nil
+}
+
+func (s *service) unindexEntry(domain string) {
+	s.index.Remove(domain)
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.expiring, domain)
+}
+
+// prepare normalizes and validates an entry before it's stored. An entry in sinkhole mode needs its own
+// addresses when there are no default ones, or its questions would be answered without addresses.
+func prepare(denied Denied, sinkhole []string) (Denied, error) {
+	denied.Domain = matcher.Normalize(denied.Domain)
+	if denied.Domain == "" {
+		return denied, ErrMissingDomain
+	}
+	if _, err := matcher.Parse(denied.Domain); err != nil {
+		return denied, fmt.Errorf("%w: %v", ErrInvalidEntry, err)
+	}
+	mode, err := ParseMode(string(denied.Mode))
+	if err != nil {
+		return denied, err
+	}
+	denied.Mode = mode
+	if err := ValidateSinkhole(denied.Sinkhole); err != nil {
+		return denied, err
+	}
+	if denied.Mode == ModeSinkhole && len(denied.Sinkhole) == 0 && len(sinkhole) == 0 {
+		return denied, fmt.Errorf("%w: sinkhole mode without sinkhole addresses", ErrInvalidEntry)
+	}
+	if denied.Schedule != nil {
+		if err := denied.Schedule.Validate(); err != nil {
+			return denied, err
+		}
+	}
+	if denied.Date.IsZero() {
+		denied.Date = time.Now()
+	}
+	return denied, nil
+}
+
+// ParseMode validates the name of a block mode. An empty name is the ModeDefault.
+func ParseMode(mode string) (Mode, error) {
+	switch m := Mode(strings.ToLower(mode)); m {
+	case ModeDefault, ModeNXDomain, ModeNoData, ModeRefused, ModeNullIP, ModeSinkhole:
+		return m, nil
+	}
+	return ModeDefault, fmt.Errorf("%w: invalid block mode %q", ErrInvalidEntry, mode)
+}
+
+// ValidateSinkhole checks that every sinkhole address is a valid IPv4 or IPv6 address.
+func ValidateSinkhole(addresses []string) error {
+	for _, address := range addresses {
+		if net.ParseIP(address) == nil {
+			return fmt.Errorf("%w: invalid sinkhole address %q", ErrInvalidEntry, address)
+		}
+	}
+	return nil
+}
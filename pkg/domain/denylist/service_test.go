@@ -0,0 +1,137 @@
+package denylist_test
+
+import (
+	"dns-proxy/pkg/domain/denylist"
+	"dns-proxy/pkg/gateway/repository"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Entries that aren't enforced now are still stored, so the API finds them while queries aren't blocked.
+func TestGetDeniedDomainNotEnforced(t *testing.T) {
+	tomorrow := time.Now().UTC().Add(24 * time.Hour).Weekday().String()[:3]
+	entries := []denylist.Denied{
+		{Domain: "scheduled.example.com", Schedule: &denylist.Schedule{Days: []string{tomorrow}, Timezone: "UTC"}},
+		{Domain: "expired.example.com", Expires: time.Now().Add(-time.Minute)},
+		{Domain: "||suffix.example.com^", Expires: time.Now().Add(-time.Minute)},
+		{Domain: "enforced.example.com"},
+	}
+	svc, err := denylist.NewService(repository.NewMemory(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.AddDeniedDomains(entries); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		domain   string
+		rule     string
+		enforced bool
+	}{
+		{domain: "scheduled.example.com", rule: "scheduled.example.com"},
+		{domain: "expired.example.com", rule: "expired.example.com"},
+		{domain: "||suffix.example.com^", rule: "||suffix.example.com^"},
+		{domain: "www.suffix.example.com", rule: "||suffix.example.com^"},
+		{domain: "enforced.example.com", rule: "enforced.example.com", enforced: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			denied, err := svc.GetDeniedDomain(tt.domain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if denied == nil || denied.Domain != tt.rule {
+				t.Fatalf("GetDeniedDomain(%q) = %+v, want the entry of %s", tt.domain, denied, tt.rule)
+			}
+			matched, err := svc.MatchDeniedDomain(tt.domain, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (matched != nil) != tt.enforced {
+				t.Errorf("MatchDeniedDomain(%q) = %+v, want enforced %v", tt.domain, matched, tt.enforced)
+			}
+		})
+	}
+}
+
+// blockingRepository holds the removals until released, to change the denylist while Flush removes entries.
+type blockingRepository struct {
+	denylist.Repository
+	removing chan struct{}
+	release  chan struct{}
+}
+
+func (r *blockingRepository) RemoveDeniedDomains(domains []string) error {
+	close(r.removing)
+	<-r.release
+	return r.Repository.RemoveDeniedDomains(domains)
+}
+
+// An entry added again with a new expiration while Flush removes the expired entries is kept.
+func TestFlushReAdded(t *testing.T) {
+	now := time.Now()
+	db := &blockingRepository{Repository: repository.NewMemory(), removing: make(chan struct{}), release: make(chan struct{})}
+	svc, err := denylist.NewService(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.AddDeniedDomain(denylist.Denied{Domain: "example.com", Expires: now.Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	flushed := make(chan error)
+	go func() { flushed <- denylist.FlushAt(svc, now) }()
+	<-db.removing
+	added := make(chan error)
+	expires := now.Add(time.Hour)
+	go func() { added <- svc.AddDeniedDomain(denylist.Denied{Domain: "example.com", Expires: expires}) }()
+	time.Sleep(50 * time.Millisecond)
+	close(db.release)
+	if err := <-flushed; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-added; err != nil {
+		t.Fatal(err)
+	}
+	if err := denylist.FlushAt(svc, now); err != nil {
+		t.Fatal(err)
+	}
+	denied, err := svc.GetDeniedDomain("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if denied == nil || !denied.Expires.Equal(expires) {
+		t.Fatalf("GetDeniedDomain(example.com) = %+v, want the entry expiring at %v", denied, expires)
+	}
+}
+
+// Entries in sinkhole mode need addresses, their own or the default ones.
+func TestAddDeniedDomainSinkhole(t *testing.T) {
+	tests := []struct {
+		name     string
+		defaults []string
+		entry    denylist.Denied
+		invalid  bool
+	}{
+		{name: "own addresses", entry: denylist.Denied{Domain: "example.com", Mode: denylist.ModeSinkhole, Sinkhole: []string{"10.0.0.53"}}},
+		{name: "default addresses", defaults: []string{"10.0.0.53"}, entry: denylist.Denied{Domain: "example.com", Mode: denylist.ModeSinkhole}},
+		{name: "no addresses", entry: denylist.Denied{Domain: "example.com", Mode: denylist.ModeSinkhole}, invalid: true},
+		{name: "other mode", entry: denylist.Denied{Domain: "example.com", Mode: denylist.ModeNXDomain}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, err := denylist.NewService(repository.NewMemory(), tt.defaults)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = svc.AddDeniedDomain(tt.entry)
+			if tt.invalid != errors.Is(err, denylist.ErrInvalidEntry) {
+				t.Errorf("AddDeniedDomain(%+v) = %v, want invalid %v", tt.entry, err, tt.invalid)
+			}
+			err = svc.AddDeniedDomains([]denylist.Denied{tt.entry})
+			if tt.invalid != errors.Is(err, denylist.ErrInvalidEntry) {
+				t.Errorf("AddDeniedDomains(%+v) = %v, want invalid %v", tt.entry, err, tt.invalid)
+			}
+		})
+	}
+}
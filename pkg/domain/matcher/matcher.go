@@ -0,0 +1,278 @@
+package matcher
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Kind is the kind of domain rule, selected by the syntax of the rule.
+type Kind int
+
+const (
+	// Exact rules like 'example.com' only match the domain itself.
+	Exact Kind = iota
+	// Wildcard rules like '*.example.com' match the subdomains of the domain but not the domain itself.
+	Wildcard
+	// Suffix rules like '||example.com^' (adblock style) match the domain and all its subdomains.
+	Suffix
+	// Regex rules like '/^ads[0-9]*\./' match the domains, without trailing dot, matching the expression.
+	Regex
+	// Network rules like '203.0.113.0/24' or '2001:db8::1' match IP addresses instead of domains.
+	Network
+)
+
+// ErrInvalidRule is wrapped by the errors returned for rules that can't be parsed.
+var ErrInvalidRule = errors.New("invalid rule")
+
+// Rule is a parsed rule. Pattern is the domain for the trie based kinds, the expression for Regex and the
+// CIDR for Network.
+type Rule struct {
+	Kind    Kind
+	Pattern string
+}
+
+// Parse reads the kind of rule and its pattern.
+func Parse(rule string) (Rule, error) {
+	var parsed Rule
+	switch {
+	case len(rule) > 2 && strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/"):
+		parsed = Rule{Kind: Regex, Pattern: rule[1 : len(rule)-1]}
+		if _, err := regexp.Compile(parsed.Pattern); err != nil {
+			return parsed, fmt.Errorf("%w %q: %v", ErrInvalidRule, rule, err)
+		}
+		return parsed, nil
+	case strings.Contains(rule, "/"):
+		if _, network, err := net.ParseCIDR(rule); err == nil {
+			return Rule{Kind: Network, Pattern: network.String()}, nil
+		}
+		return parsed, fmt.Errorf("%w %q", ErrInvalidRule, rule)
+	case net.ParseIP(rule) != nil:
+		ip := net.ParseIP(rule)
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			bits = 8 * net.IPv4len
+		}
+		return Rule{Kind: Network, Pattern: (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}).String()}, nil
+	case strings.HasPrefix(rule, "||"):
+		parsed = Rule{Kind: Suffix, Pattern: strings.TrimSuffix(rule[2:], "^")}
+	case strings.HasPrefix(rule, "*."):
+		parsed = Rule{Kind: Wildcard, Pattern: rule[2:]}
+	default:
+		parsed = Rule{Kind: Exact, Pattern: rule}
+	}
+	if parsed.Pattern == "" || strings.ContainsAny(parsed.Pattern, "*^|/ ") || strings.Contains(parsed.Pattern, "..") {
+		return parsed, fmt.Errorf("%w %q", ErrInvalidRule, rule)
+	}
+	return parsed, nil
+}
+
+// Normalize lowercases the domain and removes the trailing dot of fully qualified names, so 'Example.com.'
+// coming from a DNS question matches 'example.com' coming from the API. Regex rules are kept as they are.
+func Normalize(domain string) string {
+	if rule, err := Parse(domain); err == nil && rule.Kind == Regex {
+		return domain
+	}
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// InLists reports whether an entry tagged with sources applies to the lists. Entries without sources apply
+// to every list, and nil lists accept every entry.
+func InLists(sources, lists []string) bool {
+	if len(sources) == 0 || lists == nil {
+		return true
+	}
+	for _, source := range sources {
+		for _, list := range lists {
+			if source == list {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// node is a label of the trie. The fields hold the rules ending at this label.
+type node struct {
+	children map[string]*node
+	exact    string
+	wildcard string
+	suffix   string
+}
+
+func (n *node) empty() bool {
+	return len(n.children) == 0 && n.exact == "" && n.wildcard == "" && n.suffix == ""
+}
+
+// regexRule is a Regex rule with its compiled expression.
+type regexRule struct {
+	rule       string
+	expression *regexp.Regexp
+}
+
+// Matcher indexes domain rules in a trie of reversed labels, so a lookup costs O(labels) no matter how many
+// rules are indexed. Regex rules can't be indexed and are evaluated one by one when the trie has no match,
+// sorted by rule so the same one wins every time when several match. Network rules are indexed apart in a
+// binary trie of address bits.
+type Matcher struct {
+	mx       sync.RWMutex
+	root     *node
+	regexps  []regexRule
+	networks *bitNode
+}
+
+func New() *Matcher {
+	return &Matcher{
+		root:     &node{},
+		networks: &bitNode{},
+	}
+}
+
+// Add indexes the rule. Adding a rule twice has no effect.
+func (m *Matcher) Add(rule string) error {
+	parsed, err := Parse(rule)
+	if err != nil {
+		return err
+	}
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	switch parsed.Kind {
+	case Regex:
+		if i, found := m.findRegex(rule); !found {
+			m.regexps = append(m.regexps, regexRule{})
+			copy(m.regexps[i+1:], m.regexps[i:])
+			m.regexps[i] = regexRule{rule: rule, expression: regexp.MustCompile(parsed.Pattern)}
+		}
+		return nil
+	case Network:
+		m.networks.add(parsed.Pattern, rule)
+		return nil
+	}
+	n := m.root
+	for _, label := range reversedLabels(parsed.Pattern) {
+		child, ok := n.children[label]
+		if !ok {
+			if n.children == nil {
+				n.children = map[string]*node{}
+			}
+			child = &node{}
+			n.children[label] = child
+		}
+		n = child
+	}
+	switch parsed.Kind {
+	case Exact:
+		n.exact = rule
+	case Wildcard:
+		n.wildcard = rule
+	case Suffix:
+		n.suffix = rule
+	}
+	return nil
+}
+
+// Remove drops the rule from the index, pruning the labels left without rules.
+func (m *Matcher) Remove(rule string) {
+	parsed, err := Parse(rule)
+	if err != nil {
+		return
+	}
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	switch parsed.Kind {
+	case Regex:
+		if i, found := m.findRegex(rule); found {
+			m.regexps = append(m.regexps[:i], m.regexps[i+1:]...)
+		}
+		return
+	case Network:
+		m.networks.remove(parsed.Pattern)
+		return
+	}
+	labels := reversedLabels(parsed.Pattern)
+	path := make([]*node, 0, len(labels)+1)
+	n := m.root
+	path = append(path, n)
+	for _, label := range labels {
+		child, ok := n.children[label]
+		if !ok {
+			return
+		}
+		n = child
+		path = append(path, n)
+	}
+	switch parsed.Kind {
+	case Exact:
+		n.exact = ""
+	case Wildcard:
+		n.wildcard = ""
+	case Suffix:
+		n.suffix = ""
+	}
+	for i := len(labels); i > 0 && path[i].empty(); i-- {
+		delete(path[i-1].children, labels[i-1])
+	}
+}
+
+// Match returns the most specific rule matching the domain. Exact rules win over the rest, then the rules of
+// the longest domains, and regex rules are only looked up when no other rule matches.
+func (m *Matcher) Match(domain string) (string, bool) {
+	return m.MatchFunc(domain, func(string) bool { return true })
+}
+
+// MatchFunc goes through the rules matching the domain, from the most specific to the least one, and
+// returns the first rule accepted by the function.
+func (m *Matcher) MatchFunc(domain string, accept func(rule string) bool) (string, bool) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	labels := reversedLabels(domain)
+	var matches []string
+	n := m.root
+	for i, label := range labels {
+		child, ok := n.children[label]
+		if !ok {
+			break
+		}
+		n = child
+		if n.suffix != "" {
+			matches = append(matches, n.suffix)
+		}
+		if i == len(labels)-1 {
+			if n.exact != "" {
+				matches = append(matches, n.exact)
+			}
+		} else if n.wildcard != "" {
+			matches = append(matches, n.wildcard)
+		}
+	}
+	for i := len(matches) - 1; i >= 0; i-- {
+		if accept(matches[i]) {
+			return matches[i], true
+		}
+	}
+	for _, r := range m.regexps {
+		if r.expression.MatchString(domain) && accept(r.rule) {
+			return r.rule, true
+		}
+	}
+	return "", false
+}
+
+// findRegex returns the position of the Regex rule in the sorted rules, or where it goes if it isn't there.
+func (m *Matcher) findRegex(rule string) (int, bool) {
+	i := sort.Search(len(m.regexps), func(i int) bool { return m.regexps[i].rule >= rule })
+	return i, i < len(m.regexps) && m.regexps[i].rule == rule
+}
+
+// reversedLabels splits the domain in its labels starting from the top level domain.
+func reversedLabels(domain string) []string {
+	labels := strings.Split(domain, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
@@ -0,0 +1,222 @@
+package matcher
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		rule    string
+		want    Rule
+		invalid bool
+	}{
+		{rule: "example.com", want: Rule{Kind: Exact, Pattern: "example.com"}},
+		{rule: "*.example.com", want: Rule{Kind: Wildcard, Pattern: "example.com"}},
+		{rule: "||example.com^", want: Rule{Kind: Suffix, Pattern: "example.com"}},
+		{rule: "||example.com", want: Rule{Kind: Suffix, Pattern: "example.com"}},
+		{rule: `/^ads[0-9]*\./`, want: Rule{Kind: Regex, Pattern: `^ads[0-9]*\.`}},
+		{rule: "10.1.2.0/24", want: Rule{Kind: Network, Pattern: "10.1.2.0/24"}},
+		{rule: "10.1.2.3/24", want: Rule{Kind: Network, Pattern: "10.1.2.0/24"}},
+		{rule: "10.1.2.3", want: Rule{Kind: Network, Pattern: "10.1.2.3/32"}},
+		{rule: "2001:db8::1", want: Rule{Kind: Network, Pattern: "2001:db8::1/128"}},
+		{rule: "", invalid: true},
+		{rule: "*.", invalid: true},
+		{rule: "a..com", invalid: true},
+		{rule: "ex ample.com", invalid: true},
+		{rule: "*.*.example.com", invalid: true},
+		{rule: "/[/", invalid: true},
+		{rule: "10.0.0.0/33", invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			got, err := Parse(tt.rule)
+			if tt.invalid {
+				if !errors.Is(err, ErrInvalidRule) {
+					t.Fatalf("Parse(%q) error = %v, want ErrInvalidRule", tt.rule, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse(%q) error = %v", tt.rule, err)
+			}
+			if got != tt.want {
+				t.Errorf("Parse(%q) = %+v, want %+v", tt.rule, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	m := newMatcher(t,
+		"example.com",
+		"*.wild.com",
+		"||ads.com^",
+		"sub.ads.com",
+		"||example.org^",
+		"*.a.example.org",
+		`/^track[0-9]+\./`,
+	)
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		// Exact rules only match the domain itself.
+		{domain: "example.com", want: "example.com"},
+		{domain: "www.example.com"},
+		// Wildcard rules match the subdomains at any depth, but not the domain.
+		{domain: "wild.com"},
+		{domain: "a.wild.com", want: "*.wild.com"},
+		{domain: "a.b.wild.com", want: "*.wild.com"},
+		// Suffix rules match the domain and its subdomains.
+		{domain: "ads.com", want: "||ads.com^"},
+		{domain: "x.y.ads.com", want: "||ads.com^"},
+		{domain: "notads.com"},
+		// Exact rules win, then the rules of the longest domains.
+		{domain: "sub.ads.com", want: "sub.ads.com"},
+		{domain: "x.sub.ads.com", want: "||ads.com^"},
+		{domain: "b.a.example.org", want: "*.a.example.org"},
+		{domain: "a.example.org", want: "||example.org^"},
+		// Regex rules are evaluated when nothing else matches.
+		{domain: "track42.example.net", want: `/^track[0-9]+\./`},
+		{domain: "tracker.example.net"},
+		{domain: "com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			got, ok := m.Match(tt.domain)
+			if ok != (tt.want != "") || got != tt.want {
+				t.Errorf("Match(%q) = %q, %v, want %q", tt.domain, got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchFunc(t *testing.T) {
+	m := newMatcher(t, "||example.com^", "*.example.com", "www.example.com")
+	var seen []string
+	got, ok := m.MatchFunc("www.example.com", func(rule string) bool {
+		seen = append(seen, rule)
+		return rule == "||example.com^"
+	})
+	if !ok || got != "||example.com^" {
+		t.Fatalf("MatchFunc() = %q, %v, want ||example.com^", got, ok)
+	}
+	want := []string{"www.example.com", "*.example.com", "||example.com^"}
+	if fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Errorf("MatchFunc() visited %v, want %v", seen, want)
+	}
+}
+
+// When several regex rules match, the same one wins whatever the order they were added in.
+func TestMatchRegexOrder(t *testing.T) {
+	rules := []string{`/^ads/`, `/\.example\.com$/`, `/ads[0-9]+/`, `/^a/`}
+	for _, order := range [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {1, 3, 0, 2}} {
+		m := New()
+		for _, i := range order {
+			if err := m.Add(rules[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		m.Add(rules[order[0]])
+		for i := 0; i < 10; i++ {
+			if got, _ := m.Match("ads1.example.com"); got != `/\.example\.com$/` {
+				t.Fatalf("Match() with rules added in order %v = %q, want the first rule sorted", order, got)
+			}
+		}
+		m.Remove(`/\.example\.com$/`)
+		if got, _ := m.Match("ads1.example.com"); got != `/^a/` {
+			t.Errorf("Match() after removing a rule = %q, want the next one sorted", got)
+		}
+	}
+}
+
+func TestMatchIP(t *testing.T) {
+	m := newMatcher(t, "10.0.0.0/8", "10.1.0.0/16", "10.1.2.3", "2001:db8::/32", "2001:db8:1::/48")
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "10.1.2.3", want: "10.1.2.3"},
+		{ip: "10.1.2.4", want: "10.1.0.0/16"},
+		{ip: "10.200.0.1", want: "10.0.0.0/8"},
+		{ip: "11.0.0.1"},
+		{ip: "2001:db8:1::1", want: "2001:db8:1::/48"},
+		{ip: "2001:db8:2::1", want: "2001:db8::/32"},
+		{ip: "2001:db9::1"},
+		// IPv4-mapped IPv6 addresses are the same addresses as their IPv4 form.
+		{ip: "::ffff:10.1.2.3", want: "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			got, ok := m.MatchIP(net.ParseIP(tt.ip))
+			if ok != (tt.want != "") || got != tt.want {
+				t.Errorf("MatchIP(%s) = %q, %v, want %q", tt.ip, got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemove(t *testing.T) {
+	rules := []string{"example.com", "*.example.com", "||ads.com^", "a.b.ads.com", `/^ads\./`, "10.0.0.0/8", "10.1.0.0/16"}
+	m := newMatcher(t, rules...)
+
+	m.Remove("example.com")
+	if got, ok := m.Match("example.com"); ok {
+		t.Errorf("Match(example.com) = %q after removing it", got)
+	}
+	if got, _ := m.Match("www.example.com"); got != "*.example.com" {
+		t.Errorf("Match(www.example.com) = %q, want the wildcard rule left on the same label", got)
+	}
+	m.Remove("10.1.0.0/16")
+	if got, _ := m.MatchIP(net.ParseIP("10.1.2.3")); got != "10.0.0.0/8" {
+		t.Errorf("MatchIP(10.1.2.3) = %q, want the shorter prefix left", got)
+	}
+	m.Remove(`/^ads\./`)
+	if got, ok := m.Match("ads.example.net"); ok {
+		t.Errorf("Match(ads.example.net) = %q after removing the regex", got)
+	}
+
+	for _, rule := range rules {
+		m.Remove(rule)
+	}
+	if !m.root.empty() {
+		t.Errorf("label trie not pruned after removing every rule: %+v", m.root.children)
+	}
+	if len(m.regexps) != 0 {
+		t.Errorf("regex rules left after removing every rule: %v", m.regexps)
+	}
+	if !m.networks.empty() {
+		t.Errorf("network trie not pruned after removing every rule")
+	}
+}
+
+func TestRemoveNetworkChurn(t *testing.T) {
+	m := New()
+	for i := 0; i < 1000; i++ {
+		rule := fmt.Sprintf("10.%d.%d.0/24", i/256, i%256)
+		if err := m.Add(rule); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.MatchIP(net.ParseIP(fmt.Sprintf("10.%d.%d.1", i/256, i%256))); !ok {
+			t.Fatalf("MatchIP() found no rule after adding %s", rule)
+		}
+		m.Remove(rule)
+	}
+	if !m.networks.empty() {
+		t.Errorf("network trie grows with added and removed rules")
+	}
+}
+
+func newMatcher(t *testing.T, rules ...string) *Matcher {
+	t.Helper()
+	m := New()
+	for _, rule := range rules {
+		if err := m.Add(rule); err != nil {
+			t.Fatalf("Add(%q) error = %v", rule, err)
+		}
+	}
+	return m
+}
@@ -0,0 +1,111 @@
+package matcher
+
+import (
+	"net"
+)
+
+// bitNode is a node of the binary trie indexing the network rules. Every level is a bit of the address, so
+// the rule of a network lives at the depth of its prefix length. IPv4 networks are indexed in their
+// IPv4-mapped IPv6 form to share the trie with IPv6 ones.
+type bitNode struct {
+	children [2]*bitNode
+	rule     string
+}
+
+// add sets the rule of the network.
+func (n *bitNode) add(cidr, rule string) {
+	ip, ones, ok := prefix(cidr)
+	if !ok {
+		return
+	}
+	for i := 0; i < ones; i++ {
+		b := bit(ip, i)
+		if n.children[b] == nil {
+			n.children[b] = &bitNode{}
+		}
+		n = n.children[b]
+	}
+	n.rule = rule
+}
+
+// remove drops the rule of the network, pruning the nodes left without rules nor children so the trie
+// doesn't grow as rules are added and removed.
+func (n *bitNode) remove(cidr string) {
+	ip, ones, ok := prefix(cidr)
+	if !ok {
+		return
+	}
+	path := make([]*bitNode, 0, ones+1)
+	path = append(path, n)
+	for i := 0; i < ones; i++ {
+		if n = n.children[bit(ip, i)]; n == nil {
+			return
+		}
+		path = append(path, n)
+	}
+	n.rule = ""
+	for i := ones; i > 0 && path[i].empty(); i-- {
+		path[i-1].children[bit(ip, i-1)] = nil
+	}
+}
+
+func (n *bitNode) empty() bool {
+	return n.rule == "" && n.children[0] == nil && n.children[1] == nil
+}
+
+// prefix returns the address of the network in its 16 bytes form and the length of its prefix within it.
+func prefix(cidr string) (net.IP, int, bool) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, 0, false
+	}
+	ones, bits := network.Mask.Size()
+	if bits == 8*net.IPv4len {
+		ones += 8 * (net.IPv6len - net.IPv4len)
+	}
+	return network.IP.To16(), ones, true
+}
+
+// match returns the rules of the networks containing the ip, from the longest prefix to the shortest one.
+func (n *bitNode) match(ip net.IP) []string {
+	ip = ip.To16()
+	if ip == nil {
+		return nil
+	}
+	var matches []string
+	for i := 0; n != nil; i++ {
+		if n.rule != "" {
+			matches = append(matches, n.rule)
+		}
+		if i == 8*net.IPv6len {
+			break
+		}
+		n = n.children[bit(ip, i)]
+	}
+	for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+		matches[i], matches[j] = matches[j], matches[i]
+	}
+	return matches
+}
+
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+// MatchIP returns the rule of the most specific network containing the ip.
+func (m *Matcher) MatchIP(ip net.IP) (string, bool) {
+	return m.MatchIPFunc(ip, func(string) bool { return true })
+}
+
+// MatchIPFunc goes through the rules of the networks containing the ip, from the most specific to the least
+// one, and returns the first rule accepted by the function.
+func (m *Matcher) MatchIPFunc(ip net.IP, accept func(rule string) bool) (string, bool) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	for _, rule := range m.networks.match(ip) {
+		if accept(rule) {
+			return rule, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,75 @@
+package policy
+
+import (
+	"dns-proxy/pkg/domain/denylist"
+	"net"
+	"time"
+)
+
+// Group binds the clients of some networks to the lists filtering their queries. The lists are matched
+// against the sources of the denylist and allowlist entries. Nil lists apply every entry.
+// When the group has a Schedule its denylists are only applied within it.
+type Group struct {
+	Name       string
+	Networks   []*net.IPNet
+	Denylists  []string
+	Allowlists []string
+	Schedule   *denylist.Schedule
+}
+
+// ActiveDenylists returns the denylists applied to the group at the given time. Out of the schedule only the
+// entries without sources are applied.
+func (g *Group) ActiveDenylists(t time.Time) []string {
+	if g.Schedule != nil && !g.Schedule.Active(t) {
+		return []string{}
+	}
+	return g.Denylists
+}
+
+// Service finds the group of a client.
+type Service interface {
+	GetGroup(net.Addr) *Group
+}
+
+// service implements the Service interface looking for the most specific network containing the client.
+type service struct {
+	groups []Group
+}
+
+func NewService(groups []Group) Service {
+	return &service{groups: groups}
+}
+
+// GetGroup returns the group with the most specific network containing the address, or nil if the client
+// doesn't belong to any group.
+func (s *service) GetGroup(addr net.Addr) *Group {
+	ip := addrIP(addr)
+	if ip == nil {
+		return nil
+	}
+	var group *Group
+	longest := -1
+	for i := range s.groups {
+		for _, network := range s.groups[i].Networks {
+			if !network.Contains(ip) {
+				continue
+			}
+			if ones, _ := network.Mask.Size(); ones > longest {
+				group, longest = &s.groups[i], ones
+			}
+		}
+	}
+	return group
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package policy_test
+
+import (
+	"dns-proxy/pkg/domain/denylist"
+	"dns-proxy/pkg/domain/policy"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func network(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// The group with the most specific network containing the client is selected, whatever the order of the groups.
+func TestGetGroup(t *testing.T) {
+	groups := []policy.Group{
+		{Name: "servers", Networks: []*net.IPNet{network(t, "10.1.0.0/16")}},
+		{Name: "lan", Networks: []*net.IPNet{network(t, "10.0.0.0/8"), network(t, "fd00::/8")}},
+		{Name: "printer", Networks: []*net.IPNet{network(t, "10.1.2.3/32")}},
+		{Name: "guests", Networks: []*net.IPNet{network(t, "192.168.0.0/16"), network(t, "fd00:1::/32")}},
+	}
+	svc := policy.NewService(groups)
+	tests := []struct {
+		name string
+		addr net.Addr
+		want string
+	}{
+		{name: "network /8", addr: &net.UDPAddr{IP: net.ParseIP("10.9.9.9"), Port: 53}, want: "lan"},
+		{name: "network /16", addr: &net.TCPAddr{IP: net.ParseIP("10.1.9.9"), Port: 53}, want: "servers"},
+		{name: "network /32", addr: &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 53}, want: "printer"},
+		{name: "IPv6 /8", addr: &net.UDPAddr{IP: net.ParseIP("fd00:2::1"), Port: 53}, want: "lan"},
+		{name: "IPv6 /32", addr: &net.IPAddr{IP: net.ParseIP("fd00:1::1")}, want: "guests"},
+		{name: "no group", addr: &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 53}},
+		{name: "no IP", addr: &net.UnixAddr{Name: "/tmp/pronsy.sock", Net: "unix"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group := svc.GetGroup(tt.addr)
+			var got string
+			if group != nil {
+				got = group.Name
+			}
+			if got != tt.want {
+				t.Errorf("GetGroup(%v) = %q, want %q", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestActiveDenylists(t *testing.T) {
+	// 2026-01-05 is a Monday.
+	monday := time.Date(2026, time.January, 5, 12, 0, 0, 0, time.UTC)
+	schedule := &denylist.Schedule{Days: []string{"mon"}, From: "09:00", To: "17:00", Timezone: "UTC"}
+	tests := []struct {
+		name  string
+		group policy.Group
+		t     time.Time
+		want  []string
+	}{
+		{name: "no schedule", group: policy.Group{Denylists: []string{"ads"}}, t: monday, want: []string{"ads"}},
+		{name: "every list", group: policy.Group{}, t: monday},
+		{name: "in schedule", group: policy.Group{Denylists: []string{"ads"}, Schedule: schedule}, t: monday, want: []string{"ads"}},
+		{name: "out of schedule", group: policy.Group{Denylists: []string{"ads"}, Schedule: schedule}, t: monday.Add(6 * time.Hour), want: []string{}},
+		{name: "every list out of schedule", group: policy.Group{Schedule: schedule}, t: monday.Add(24 * time.Hour), want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.group.ActiveDenylists(tt.t); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ActiveDenylists(%v) = %#v, want %#v", tt.t, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"dns-proxy/pkg/domain/denylist"
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// blockedTTL is the TTL, in seconds, of the records synthesized for denied domains.
+const blockedTTL = 60
+
+// Blocking is the answer given to denied domains when their denylist entry doesn't define one.
+type Blocking struct {
+	Mode     denylist.Mode
+	Sinkhole []string
+}
+
+// responseBuilder writes the synthesized answers for denied domains on top of dnsmessage.Builder.
+type responseBuilder struct {
+	defaults Blocking
+}
+
+// Build answers the request according to the mode of the denied entry, falling back to the defaults.
+// The response is returned raw and ready to be written, with the length prefix when the protocol is TCP.
+func (r *responseBuilder) Build(request *dnsmessage.Message, denied *denylist.Denied, protocol string) ([]byte, error) {
+	mode, sinkhole := r.defaults.Mode, r.defaults.Sinkhole
+	if denied != nil && denied.Mode != denylist.ModeDefault {
+		mode = denied.Mode
+	}
+	if denied != nil && len(denied.Sinkhole) > 0 {
+		sinkhole = denied.Sinkhole
+	}
+
+	header := dnsmessage.Header{
+		ID:                 request.Header.ID,
+		Response:           true,
+		OpCode:             request.Header.OpCode,
+		RecursionDesired:   request.Header.RecursionDesired,
+		RecursionAvailable: true,
+	}
+	switch mode {
+	case denylist.ModeNoData, denylist.ModeNullIP, denylist.ModeSinkhole:
+		header.RCode = dnsmessage.RCodeSuccess
+	case denylist.ModeRefused:
+		header.RCode = dnsmessage.RCodeRefused
+	default:
+		header.RCode = dnsmessage.RCodeNameError
+	}
+
+	// Over TCP the first two bytes are reserved for the length prefix and filled once the message is finished.
+	var buf []byte
+	if protocol == SocketTCP {
+		buf = make([]byte, 2, 514)
+	} else {
+		buf = make([]byte, 0, 512)
+	}
+	b := dnsmessage.NewBuilder(buf, header)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	for _, q := range request.Questions {
+		if err := b.Question(q); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	if mode == denylist.ModeNullIP || mode == denylist.ModeSinkhole {
+		for _, q := range request.Questions {
+			if err := addressAnswer(&b, q, mode, sinkhole); err != nil {
+				return nil, err
+			}
+		}
+	}
+	response, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+	if protocol == SocketTCP {
+		binary.BigEndian.PutUint16(response, uint16(len(response)-2))
+	}
+	return response, nil
+}
+
+// addressAnswer writes the A or AAAA record answering the question. Questions of other types, or without
+// a sinkhole address for its family, are left without answer so the client gets NODATA.
+func addressAnswer(b *dnsmessage.Builder, q dnsmessage.Question, mode denylist.Mode, sinkhole []string) error {
+	header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: blockedTTL}
+	switch q.Type {
+	case dnsmessage.TypeA:
+		ip := net.IPv4zero.To4()
+		if mode == denylist.ModeSinkhole {
+			ip = sinkholeAddress(sinkhole, true)
+		}
+		if ip == nil {
+			return nil
+		}
+		var body dnsmessage.AResource
+		copy(body.A[:], ip)
+		return b.AResource(header, body)
+	case dnsmessage.TypeAAAA:
+		ip := net.IPv6zero
+		if mode == denylist.ModeSinkhole {
+			ip = sinkholeAddress(sinkhole, false)
+		}
+		if ip == nil {
+			return nil
+		}
+		var body dnsmessage.AAAAResource
+		copy(body.AAAA[:], ip)
+		return b.AAAAResource(header, body)
+	}
+	return nil
+}
+
+// sinkholeAddress returns the first sinkhole address of the requested family.
+func sinkholeAddress(sinkhole []string, v4 bool) net.IP {
+	for _, address := range sinkhole {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			if v4 {
+				return ip4
+			}
+			continue
+		}
+		if !v4 {
+			return ip.To16()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"sort"
+	"strings"
+)
+
+// Route forwards the queries for a zone, the domain and all its subdomains, to its own resolver instead of
+// the DNS Provider. Reverse zones like '10.in-addr.arpa' route the reverse lookups of a network.
+type Route struct {
+	Zone     string
+	Resolver Resolver
+}
+
+// router picks the resolver of the queries by the zone of the domain.
+type router struct {
+	routes   []Route
+	fallback Resolver
+}
+
+func newRouter(fallback Resolver, routes []Route) *router {
+	sorted := make([]Route, 0, len(routes))
+	for _, route := range routes {
+		route.Zone = strings.ToLower(strings.Trim(route.Zone, "."))
+		sorted = append(sorted, route)
+	}
+	// The most specific zone wins, so longer zones are tried first.
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return labels(sorted[i].Zone) > labels(sorted[j].Zone)
+	})
+	return &router{routes: sorted, fallback: fallback}
+}
+
+// resolverFor returns the resolver of the most specific zone containing the domain, or the fallback.
+func (r *router) resolverFor(domain string) Resolver {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, route := range r.routes {
+		if route.Zone == "" || domain == route.Zone || strings.HasSuffix(domain, "."+route.Zone) {
+			return route.Resolver
+		}
+	}
+	return r.fallback
+}
+
+// labels returns the number of labels of the zone, 0 for the root zone.
+func labels(zone string) int {
+	if zone == "" {
+		return 0
+	}
+	return strings.Count(zone, ".") + 1
+}
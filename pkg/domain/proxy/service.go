@@ -2,7 +2,13 @@ package proxy
 
 import (
 	"crypto/tls"
+	"dns-proxy/pkg/domain/allowlist"
 	"dns-proxy/pkg/domain/denylist"
+	"dns-proxy/pkg/domain/policy"
+	"io"
+	"net"
+	"sync"
+	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
 )
@@ -13,16 +19,55 @@ const (
 	SocketUDP = "udp"
 )
 
+// Resolver is the interface used to resolve the requests against a DNS server. Requests and responses are
+// raw messages with the length prefix of TCP, whatever the protocol spoken with the server.
 type Resolver interface {
 	Resolve(um []byte) ([]byte, error)
+}
+
+// TLSResolver is a Resolver talking to its DNS server over TLS.
+type TLSResolver interface {
+	Resolver
 	GetTLSConnection() (*tls.Conn, error)
 }
 
 // Cache is the interace used to avoid requesting the DNS provider all the time.
+// Get returns the cached answer along with its state, or nil and CacheMiss if it's not cached.
 type Cache interface {
-	Get(dnsm dnsmessage.Message) (*dnsmessage.Message, error)
+	Get(dnsm dnsmessage.Message) (*dnsmessage.Message, CacheState, error)
 	Store(dnsm dnsmessage.Message) error
 	Flush()
+	Stats() CacheStats
+}
+
+// CacheState tells how an answer found in the Cache is used.
+type CacheState int
+
+const (
+	// CacheMiss means the answer isn't cached.
+	CacheMiss CacheState = iota
+	// CacheHit is an answer that can be served.
+	CacheHit
+	// CachePrefetch is an answer that can be served, but is asked often and about to expire, so it should
+	// be refreshed in the background. It's returned once per cached answer.
+	CachePrefetch
+	// CacheStale is an expired answer. It's only served if the resolver fails or is too slow, as RFC 8767 says.
+	CacheStale
+)
+
+// CacheStats are the counters of a Cache. NegativeHits are the hits of cached NXDOMAIN and NODATA answers,
+// which are counted in Hits as well. Stale are the misses that found an expired answer to serve if the
+// resolver fails, and Prefetches the hits that asked to refresh their answer. Bytes is the approximate
+// memory taken by the entries, and Evictions the entries removed to make room for others before they expired.
+type CacheStats struct {
+	Entries      int    `json:"entries"`
+	Bytes        int    `json:"bytes"`
+	Hits         uint64 `json:"hits"`
+	Misses       uint64 `json:"misses"`
+	NegativeHits uint64 `json:"negativeHits"`
+	Stale        uint64 `json:"stale"`
+	Prefetches   uint64 `json:"prefetches"`
+	Evictions    uint64 `json:"evictions"`
 }
 
 // DNSParser is the interface used to parse the messages between the domain entity type and the *dnsmessage.Message type.
@@ -30,6 +75,7 @@ type DNSParser interface {
 	UDPMsgToDNS(m []byte) (*dnsmessage.Message, error)
 	TCPMsgToDNS(m []byte) (*dnsmessage.Message, error)
 	DNSToMsg(dnsm *dnsmessage.Message, protocol string) ([]byte, error)
+	ReadTCPMsg(r io.Reader, buf []byte) ([]byte, error)
 }
 
 // Logger interface is used to inject different implementations of loggers.
@@ -40,45 +86,70 @@ type Logger interface {
 }
 
 // Service interface is used to define the two kind of requests this proxy can solve UDP or TCP.
+// The address of the client selects the policy group filtering its queries.
 type Service interface {
-	SolveTCP([]byte) ([]byte, error)
-	SolveUDP([]byte) ([]byte, error)
+	SolveTCP([]byte, net.Addr) ([]byte, error)
+	SolveUDP([]byte, net.Addr) ([]byte, error)
 }
 
 type service struct {
-	resolver Resolver
+	router   *router
 	parser   DNSParser
 	denier   denylist.Service
+	allower  allowlist.Service
+	policies policy.Service
+	builder  *responseBuilder
 	cache    Cache
+	// staleTimeOut is how long the resolver is waited for before serving a stale answer.
+	staleTimeOut time.Duration
+	// staleRecheck is how long the stale answers of a question are served without trying the resolver
+	// again once it failed, the failure recheck timer of RFC 8767.
+	staleRecheck time.Duration
+	rechecksMx   sync.Mutex
+	// rechecks holds, by question, the time until which its stale answer is served without resolving it,
+	// since it's being refreshed or it failed recently.
+	rechecks map[string]time.Time
 	logger   Logger
 }
 
-func NewDNSProxy(r Resolver, d denylist.Service, p DNSParser, c Cache, l Logger) Service {
+// NewDNSProxy returns the proxy resolving with r, except for the zones of the routes that are forwarded to
+// their own resolvers. When only a stale answer is cached, it's served if the resolver fails or doesn't answer
+// within staleTimeOut, 0 to wait for the resolver. While it's refreshed, and for staleRecheck after the
+// resolver fails, the stale answer is served right away, 0 to try the resolver on every query.
+func NewDNSProxy(r Resolver, routes []Route, d denylist.Service, a allowlist.Service, g policy.Service, b Blocking, p DNSParser, c Cache, staleTimeOut, staleRecheck time.Duration, l Logger) Service {
 	return &service{
-		resolver: r,
-		denier:   d,
-		parser:   p,
-		cache:    c,
-		logger:   l,
+		router:       newRouter(r, routes),
+		denier:       d,
+		allower:      a,
+		policies:     g,
+		builder:      &responseBuilder{defaults: b},
+		parser:       p,
+		cache:        c,
+		staleTimeOut: staleTimeOut,
+		staleRecheck: staleRecheck,
+		rechecks:     map[string]time.Time{},
+		logger:       l,
 	}
 }
 
-func (s *service) SolveTCP(request []byte) ([]byte, error) {
-	return s.solve(request, SocketTCP)
+func (s *service) SolveTCP(request []byte, client net.Addr) ([]byte, error) {
+	return s.solve(request, SocketTCP, client)
 }
 
-func (s *service) SolveUDP(request []byte) ([]byte, error) {
-	return s.solve(request, SocketUDP)
+func (s *service) SolveUDP(request []byte, client net.Addr) ([]byte, error) {
+	return s.solve(request, SocketUDP, client)
 }
 
-func (s *service) solve(request []byte, protocol string) ([]byte, error) {
+func (s *service) solve(request []byte, protocol string, client net.Addr) ([]byte, error) {
 	var err error
 	var message *dnsmessage.Message
 	if protocol == SocketUDP {
 		// At this point 'message' is DNS format but UDP
 		message, err = s.parser.UDPMsgToDNS(request)
-		// Convert to TCP to request against the DNS provider
-		request, err = s.parser.DNSToMsg(message, SocketTCP)
+		if err == nil {
+			// Convert to TCP to request against the DNS provider
+			request, err = s.parser.DNSToMsg(message, SocketTCP)
+		}
 	}
 	if protocol == SocketTCP {
 		message, err = s.parser.TCPMsgToDNS(request)
@@ -87,31 +158,276 @@ func (s *service) solve(request []byte, protocol string) ([]byte, error) {
 		s.logger.Err("error parsing UnsolvedMsg: %v \n", err)
 		return nil, err
 	}
+	group := s.getGroup(client)
+	allowed := len(message.Questions) > 0
 	for _, q := range message.Questions {
-		// WIP look for the domain in the denylist before resolve it.
-		// denied, err := s.denier.GetDeniedDomain(q.Name.String())
-		// if err != nil {
-		// 	s.logger.Err("error looking for the domain in the denylist: %v", err)
-		// }
-		// if denied.Domain != "" {
-		// 	return nil, fmt.Errorf("domain %s found in denylist, can't resolve", q.Name.String())
-		// TODO: write 'empty' response as the DNS couldn't find the domain instead of sending an error'
-		// }
+		// Allowed domains are resolved even if a denylist rule matches them.
+		isAllowed, err := s.isAllowed(q.Name.String(), group)
+		if err != nil {
+			s.logger.Err("error looking for the domain in the allowlist: %v", err)
+		}
+		if isAllowed {
+			s.logger.Info("Resolving DNS %s: %s found in allowlist", protocol, q.Name.String())
+			continue
+		}
+		allowed = false
+		// Look for the domain in the denylist before resolve it.
+		denied, err := s.getDenied(q.Name.String(), group)
+		if err != nil {
+			s.logger.Err("error looking for the domain in the denylist: %v", err)
+		}
+		if denied != nil {
+			s.logger.Info("Blocking DNS %s: %s found in denylist", protocol, q.Name.String())
+			return s.builder.Build(message, denied, protocol)
+		}
 		s.logger.Info("Resolving DNS %s: %s ", protocol, q.Name.String())
 	}
-	// Resolve the DNS against the DNS provider.
-	// The resolver returns a TCP Raw response that can be returned by this method.
-	response, err := s.resolver.Resolve(request)
+	// Look for the answer in the cache once the question is known to be allowed for this client.
+	// Blocked answers never reach the cache, since they depend on the group of the client.
+	var response []byte
+	dnsResponse, state := s.getCached(message)
+	switch state {
+	case CachePrefetch:
+		s.prefetch(message, request)
+	case CacheStale:
+		response, dnsResponse = s.resolveOrStale(message, request, dnsResponse)
+	case CacheMiss:
+		// Resolve the DNS against the DNS provider, or the resolver the zone is forwarded to.
+		// The resolver returns a TCP Raw response that can be returned by this method.
+		response, dnsResponse, err = s.resolve(message, request)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Block the answers pointing to denied addresses or domains, like the CNAMEs used to cloak trackers.
+	if !allowed {
+		denied, err := s.getDeniedAnswer(dnsResponse, group)
+		if err != nil {
+			s.logger.Err("error looking for the answers in the denylist: %v", err)
+		}
+		if denied != nil {
+			s.logger.Info("Blocking DNS %s: answer %s found in denylist", protocol, denied.Domain)
+			return s.builder.Build(message, denied, protocol)
+		}
+	}
+	// If the protocol is TCP and the message comes from the resolver it is ready to be sent.
+	if protocol == SocketTCP && response != nil {
+		return response, nil
+	}
+	return s.parser.DNSToMsg(dnsResponse, protocol)
+}
+
+// getDeniedAnswer returns the denylist entry matching an A or AAAA address or a CNAME target of the answers.
+// CNAME targets found in the allowlist are not blocked.
+func (s *service) getDeniedAnswer(response *dnsmessage.Message, group *policy.Group) (*denylist.Denied, error) {
+	if s.denier == nil {
+		return nil, nil
+	}
+	lists := denylists(group)
+	for _, answer := range response.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			denied, err := s.denier.MatchDeniedIP(net.IP(body.A[:]), lists)
+			if err != nil || denied != nil {
+				return denied, err
+			}
+		case *dnsmessage.AAAAResource:
+			denied, err := s.denier.MatchDeniedIP(net.IP(body.AAAA[:]), lists)
+			if err != nil || denied != nil {
+				return denied, err
+			}
+		case *dnsmessage.CNAMEResource:
+			target := body.CNAME.String()
+			if allowed, err := s.isAllowed(target, group); err != nil || allowed {
+				continue
+			}
+			denied, err := s.denier.MatchDeniedDomain(target, lists)
+			if err != nil || denied != nil {
+				return denied, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+// resolve resolves the request with the resolver of its zone and caches the response. The response is
+// returned both raw, with the TCP length prefix, and parsed.
+func (s *service) resolve(message *dnsmessage.Message, request []byte) ([]byte, *dnsmessage.Message, error) {
+	response, err := s.getResolver(message).Resolve(request)
 	if err != nil {
 		s.logger.Err("resolution Error: %v \n", err)
-		return nil, err
+		return nil, nil, err
 	}
-	// If the protocol is TCP the message is ready to be sent.
-	if protocol == SocketTCP {
-		return response, nil
+	dnsResponse, err := s.parser.TCPMsgToDNS(response)
+	if err != nil {
+		s.logger.Err("error parsing response: %v \n", err)
+		return nil, nil, err
+	}
+	if len(dnsResponse.Questions) > 0 {
+		if err := s.cache.Store(*dnsResponse); err != nil {
+			s.logger.Err("Cache error: %v", err)
+		}
+	}
+	return response, dnsResponse, nil
+}
+
+// resolveOrStale resolves a request whose cached answer has expired. The stale answer is served instead if
+// the resolver fails, answers SERVFAIL or doesn't answer within staleTimeOut, as RFC 8767 says. A slow
+// resolution goes on in the background and refreshes the cache when it ends. The stale answer is served
+// right away while the question is being refreshed or if its resolution failed recently, see startRefresh.
+func (s *service) resolveOrStale(message *dnsmessage.Message, request []byte, stale *dnsmessage.Message) ([]byte, *dnsmessage.Message) {
+	type resolution struct {
+		response    []byte
+		dnsResponse *dnsmessage.Message
+		err         error
+	}
+	key := questionKey(message.Questions[0])
+	if !s.startRefresh(key) {
+		s.logger.Info("Serving stale answer for %s without resolving it", message.Questions[0].Name.String())
+		return nil, stale
+	}
+	// The request is copied since the TCP handler reuses its buffer once the query is answered.
+	request = append([]byte(nil), request...)
+	done := make(chan resolution, 1)
+	go func() {
+		response, dnsResponse, err := s.resolve(message, request)
+		s.endRefresh(key, err != nil || dnsResponse.Header.RCode == dnsmessage.RCodeServerFailure)
+		done <- resolution{response: response, dnsResponse: dnsResponse, err: err}
+	}()
+	var timeOut <-chan time.Time
+	if s.staleTimeOut > 0 {
+		timer := time.NewTimer(s.staleTimeOut)
+		defer timer.Stop()
+		timeOut = timer.C
+	}
+	select {
+	case r := <-done:
+		if r.err == nil && r.dnsResponse.Header.RCode != dnsmessage.RCodeServerFailure {
+			return r.response, r.dnsResponse
+		}
+	case <-timeOut:
+	}
+	s.logger.Info("Serving stale answer for %s", message.Questions[0].Name.String())
+	return nil, stale
+}
+
+// startRefresh reports whether the stale question can be resolved now, and marks it as being refreshed so
+// the queries coming meanwhile don't resolve it again. It can't when it's already being refreshed, or its
+// resolution failed less than staleRecheck ago.
+func (s *service) startRefresh(key string) bool {
+	if s.staleRecheck <= 0 {
+		return true
+	}
+	s.rechecksMx.Lock()
+	defer s.rechecksMx.Unlock()
+	now := time.Now()
+	if until, ok := s.rechecks[key]; ok && now.Before(until) {
+		return false
+	}
+	s.rechecks[key] = now.Add(s.staleRecheck)
+	return true
+}
+
+// endRefresh records the result of the refresh of the stale question. A failed one starts the recheck timer.
+func (s *service) endRefresh(key string, failed bool) {
+	if s.staleRecheck <= 0 {
+		return
+	}
+	s.rechecksMx.Lock()
+	defer s.rechecksMx.Unlock()
+	if !failed {
+		delete(s.rechecks, key)
+		return
+	}
+	now := time.Now()
+	// The timers of the questions not asked again are dropped along the way.
+	for k, until := range s.rechecks {
+		if !now.Before(until) {
+			delete(s.rechecks, k)
+		}
+	}
+	s.rechecks[key] = now.Add(s.staleRecheck)
+}
+
+// questionKey identifies the question in the failure recheck timers.
+func questionKey(q dnsmessage.Question) string {
+	return q.Name.String() + " " + q.Type.String() + " " + q.Class.String()
+}
+
+// prefetch refreshes the cached answer of a popular name in the background, before it expires.
+func (s *service) prefetch(message *dnsmessage.Message, request []byte) {
+	// The request is copied since the TCP handler reuses its buffer once the query is answered.
+	request = append([]byte(nil), request...)
+	go func() {
+		s.logger.Debug("Prefetching %s", message.Questions[0].Name.String())
+		s.resolve(message, request)
+	}()
+}
+
+// getCached returns a copy of the cached answer with the ID of the request and its state, or nil if it's
+// not cached.
+func (s *service) getCached(request *dnsmessage.Message) (*dnsmessage.Message, CacheState) {
+	if len(request.Questions) == 0 {
+		return nil, CacheMiss
+	}
+	cached, state, err := s.cache.Get(*request)
+	if err != nil {
+		s.logger.Err("Cache error: %v", err)
+	}
+	if cached == nil {
+		return nil, CacheMiss
+	}
+	s.logger.Debug("Message found in cache")
+	response := *cached
+	response.Header.ID = request.Header.ID
+	return &response, state
+}
+
+// getResolver returns the resolver of the zone of the question.
+func (s *service) getResolver(request *dnsmessage.Message) Resolver {
+	if len(request.Questions) == 0 {
+		return s.router.fallback
+	}
+	return s.router.resolverFor(request.Questions[0].Name.String())
+}
+
+// getGroup returns the policy group of the client, or nil if it doesn't belong to any.
+func (s *service) getGroup(client net.Addr) *policy.Group {
+	if s.policies == nil || client == nil {
+		return nil
+	}
+	return s.policies.GetGroup(client)
+}
+
+// isAllowed reports whether the domain matches a rule of the allowlists of the group.
+func (s *service) isAllowed(domain string, group *policy.Group) (bool, error) {
+	if s.allower == nil {
+		return false, nil
+	}
+	var lists []string
+	if group != nil {
+		lists = group.Allowlists
+	}
+	allowed, err := s.allower.MatchAllowedDomain(domain, lists)
+	if err != nil {
+		return false, err
+	}
+	return allowed != nil, nil
+}
+
+// getDenied returns the entry of the denylists of the group matching the domain, if any. Entries and groups
+// out of their schedule don't block. A proxy without denylist never blocks.
+func (s *service) getDenied(domain string, group *policy.Group) (*denylist.Denied, error) {
+	if s.denier == nil {
+		return nil, nil
+	}
+	return s.denier.MatchDeniedDomain(domain, denylists(group))
+}
+
+// denylists returns the denylists applied now to the group. Clients out of any group get every list.
+func denylists(group *policy.Group) []string {
+	if group == nil {
+		return nil
 	}
-	// If it was not TCP a TCP to UDP cast is needed.
-	dnsResponse, _ := s.parser.TCPMsgToDNS(response)
-	response, _ = s.parser.DNSToMsg(dnsResponse, SocketUDP)
-	return response, nil
+	return group.ActiveDenylists(time.Now())
 }
@@ -0,0 +1,339 @@
+package proxy_test
+
+import (
+	"dns-proxy/pkg/domain/allowlist"
+	"dns-proxy/pkg/domain/denylist"
+	"dns-proxy/pkg/domain/policy"
+	"dns-proxy/pkg/domain/proxy"
+	"dns-proxy/pkg/gateway/cache"
+	"dns-proxy/pkg/gateway/logger"
+	"dns-proxy/pkg/gateway/parser"
+	"dns-proxy/pkg/gateway/repository"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const staleTTL = 30 * time.Second
+
+// fakeResolver answers the queries with the function of each call, the last one for the calls past them.
+type fakeResolver struct {
+	mx      sync.Mutex
+	calls   int
+	answers []func(request []byte) ([]byte, error)
+}
+
+func (r *fakeResolver) Resolve(request []byte) ([]byte, error) {
+	r.mx.Lock()
+	answer := r.answers[min(r.calls, len(r.answers)-1)]
+	r.calls++
+	r.mx.Unlock()
+	return answer(request)
+}
+
+func (r *fakeResolver) callCount() int {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.calls
+}
+
+// answerA answers with the address and TTL.
+func answerA(a byte, ttl uint32) func([]byte) ([]byte, error) {
+	return func(request []byte) ([]byte, error) {
+		return respond(request, dnsmessage.RCodeSuccess, func(q dnsmessage.Question) []dnsmessage.Resource {
+			return []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, a}},
+			}}
+		})
+	}
+}
+
+func serverFailure(request []byte) ([]byte, error) {
+	return respond(request, dnsmessage.RCodeServerFailure, func(dnsmessage.Question) []dnsmessage.Resource { return nil })
+}
+
+func failure([]byte) ([]byte, error) {
+	return nil, errors.New("DNS Provider down")
+}
+
+// respond builds the response to the request with the answers of its question, both with the TCP prefix.
+func respond(request []byte, rcode dnsmessage.RCode, answers func(dnsmessage.Question) []dnsmessage.Resource) ([]byte, error) {
+	p := parser.NewDNSParser()
+	msg, err := p.TCPMsgToDNS(request)
+	if err != nil {
+		return nil, err
+	}
+	msg.Header.Response = true
+	msg.Header.RCode = rcode
+	msg.Answers = answers(msg.Questions[0])
+	return p.DNSToMsg(msg, proxy.SocketTCP)
+}
+
+func newProxy(r proxy.Resolver, staleTimeOut, staleRecheck time.Duration) proxy.Service {
+	l := logger.New("TEST", false)
+	c := cache.New(0, 0, time.Hour, time.Hour, staleTTL, 0, cache.EvictionLRU, 0, 0, 1, l, true)
+	return proxy.NewDNSProxy(r, nil, nil, nil, nil, proxy.Blocking{}, parser.NewDNSParser(), c, staleTimeOut, staleRecheck, l)
+}
+
+// solve sends an A query for example.com over UDP and returns the address and the TTL of the answer.
+func solve(t *testing.T, p proxy.Service) (byte, uint32) {
+	t.Helper()
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 7, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	request, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := p.SolveUDP(request, nil)
+	if err != nil {
+		t.Fatalf("SolveUDP() error = %v", err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if msg.Header.ID != 7 || len(msg.Answers) != 1 {
+		t.Fatalf("response = %+v, want one answer with the ID of the query", msg)
+	}
+	return msg.Answers[0].Body.(*dnsmessage.AResource).A[3], msg.Answers[0].Header.TTL
+}
+
+func TestSolveStaleOnFailure(t *testing.T) {
+	for name, fail := range map[string]func([]byte) ([]byte, error){"error": failure, "SERVFAIL": serverFailure} {
+		t.Run(name, func(t *testing.T) {
+			// The answer expires as soon as it's cached.
+			p := newProxy(&fakeResolver{answers: []func([]byte) ([]byte, error){answerA(1, 0), fail}}, 0, 0)
+			if a, _ := solve(t, p); a != 1 {
+				t.Fatalf("answer = 192.0.2.%d, want the one of the resolver", a)
+			}
+			if a, ttl := solve(t, p); a != 1 || ttl != uint32(staleTTL/time.Second) {
+				t.Errorf("answer = 192.0.2.%d with TTL %d, want the stale one with TTL %v", a, ttl, staleTTL)
+			}
+		})
+	}
+}
+
+// A resolver slower than the stale time out gets the stale answer served, and refreshes the cache once it
+// answers.
+func TestSolveStaleOnSlowResolver(t *testing.T) {
+	release := make(chan struct{})
+	slow := func(request []byte) ([]byte, error) {
+		<-release
+		return answerA(2, 60)(request)
+	}
+	r := &fakeResolver{answers: []func([]byte) ([]byte, error){answerA(1, 0), slow}}
+	const staleTimeOut = 100 * time.Millisecond
+	p := newProxy(r, staleTimeOut, time.Minute)
+	solve(t, p)
+
+	start := time.Now()
+	a, ttl := solve(t, p)
+	if elapsed := time.Since(start); elapsed < staleTimeOut || elapsed > 10*staleTimeOut {
+		t.Errorf("stale answer served after %v, want after the stale time out of %v", elapsed, staleTimeOut)
+	}
+	if a != 1 || ttl != uint32(staleTTL/time.Second) {
+		t.Errorf("answer = 192.0.2.%d with TTL %d, want the stale one", a, ttl)
+	}
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for a != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		a, _ = solve(t, p)
+	}
+	if a != 2 {
+		t.Fatal("cache not refreshed after the slow resolution ended")
+	}
+	if calls := r.callCount(); calls != 2 {
+		t.Errorf("resolver called %d times, want 2", calls)
+	}
+}
+
+// Once the resolver fails, the stale answer is served without resolving it again until the recheck timer
+// ends.
+func TestSolveStaleRecheck(t *testing.T) {
+	r := &fakeResolver{answers: []func([]byte) ([]byte, error){answerA(1, 0), failure}}
+	const staleRecheck = 200 * time.Millisecond
+	p := newProxy(r, 0, staleRecheck)
+	solve(t, p)
+	for i := 0; i < 5; i++ {
+		if a, ttl := solve(t, p); a != 1 || ttl != uint32(staleTTL/time.Second) {
+			t.Fatalf("answer = 192.0.2.%d with TTL %d, want the stale one", a, ttl)
+		}
+	}
+	if calls := r.callCount(); calls != 2 {
+		t.Errorf("resolver called %d times within the recheck time, want 2", calls)
+	}
+	time.Sleep(staleRecheck + 50*time.Millisecond)
+	solve(t, p)
+	if calls := r.callCount(); calls != 3 {
+		t.Errorf("resolver called %d times after the recheck time, want 3", calls)
+	}
+}
+
+// prefetchCache asks to prefetch the next hit once prefetch is set, like the cache does for a popular answer
+// about to expire.
+type prefetchCache struct {
+	proxy.Cache
+	prefetch atomic.Bool
+}
+
+func (c *prefetchCache) Get(msg dnsmessage.Message) (*dnsmessage.Message, proxy.CacheState, error) {
+	cached, state, err := c.Cache.Get(msg)
+	if state == proxy.CacheHit && c.prefetch.CompareAndSwap(true, false) {
+		state = proxy.CachePrefetch
+	}
+	return cached, state, err
+}
+
+// An answer to prefetch is served from the cache and resolved again once in the background.
+func TestSolvePrefetch(t *testing.T) {
+	r := &fakeResolver{answers: []func([]byte) ([]byte, error){answerA(1, 60), answerA(2, 60)}}
+	l := logger.New("TEST", false)
+	c := &prefetchCache{Cache: cache.New(0, 0, time.Hour, 0, 0, 0, cache.EvictionLRU, 0, 0, 1, l, true)}
+	p := proxy.NewDNSProxy(r, nil, nil, nil, nil, proxy.Blocking{}, parser.NewDNSParser(), c, 0, 0, l)
+	solve(t, p)
+	c.prefetch.Store(true)
+
+	if a, _ := solve(t, p); a != 1 {
+		t.Errorf("answer = 192.0.2.%d, want the cached one served while prefetching", a)
+	}
+	deadline := time.Now().Add(time.Second)
+	a := byte(1)
+	for a != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		a, _ = solve(t, p)
+	}
+	if a != 2 {
+		t.Fatal("cache not refreshed by the prefetch")
+	}
+	if calls := r.callCount(); calls != 2 {
+		t.Errorf("resolver called %d times, want 2", calls)
+	}
+}
+
+// The lists of the group of the client select the denylist and allowlist entries applied by their sources.
+// Entries without sources apply to every client, and a group out of its schedule only gets them.
+func TestSolveGroups(t *testing.T) {
+	denier, err := denylist.NewService(repository.NewMemory(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = denier.AddDeniedDomains([]denylist.Denied{
+		{Domain: "ads.example.com", Sources: []string{"ads"}},
+		{Domain: "tracker.example.com", Sources: []string{"trackers"}},
+		{Domain: "global.example.com"},
+		{Domain: "infra.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allower, err := allowlist.NewService(repository.NewMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := allower.AddAllowedDomain(allowlist.Allowed{Domain: "infra.example.com", Sources: []string{"infra"}}); err != nil {
+		t.Fatal(err)
+	}
+	// The schedule is a day that isn't today.
+	later := time.Now().UTC().Add(72 * time.Hour).Weekday().String()[:3]
+	groups := []policy.Group{
+		{Name: "lan", Networks: []*net.IPNet{cidr(t, "10.0.0.0/8")}, Denylists: []string{"ads", "trackers"}, Allowlists: []string{}},
+		{Name: "servers", Networks: []*net.IPNet{cidr(t, "10.1.0.0/16")}, Denylists: []string{"trackers"}, Allowlists: []string{"infra"}},
+		{
+			Name:       "night",
+			Networks:   []*net.IPNet{cidr(t, "10.2.0.0/16")},
+			Denylists:  []string{"ads"},
+			Allowlists: []string{},
+			Schedule:   &denylist.Schedule{Days: []string{later}, Timezone: "UTC"},
+		},
+	}
+	l := logger.New("TEST", false)
+	p := proxy.NewDNSProxy(
+		&fakeResolver{answers: []func([]byte) ([]byte, error){answerA(1, 60)}},
+		nil,
+		denier,
+		allower,
+		policy.NewService(groups),
+		proxy.Blocking{},
+		parser.NewDNSParser(),
+		cache.New(0, 0, time.Hour, time.Hour, staleTTL, 0, cache.EvictionLRU, 0, 0, 1, l, true),
+		0,
+		0,
+		l,
+	)
+	tests := []struct {
+		client  string
+		domain  string
+		blocked bool
+	}{
+		{client: "10.9.9.9", domain: "ads.example.com", blocked: true},
+		{client: "10.9.9.9", domain: "tracker.example.com", blocked: true},
+		{client: "10.9.9.9", domain: "global.example.com", blocked: true},
+		{client: "10.9.9.9", domain: "infra.example.com", blocked: true},
+		{client: "10.1.9.9", domain: "ads.example.com"},
+		{client: "10.1.9.9", domain: "tracker.example.com", blocked: true},
+		{client: "10.1.9.9", domain: "global.example.com", blocked: true},
+		{client: "10.1.9.9", domain: "infra.example.com"},
+		{client: "10.2.9.9", domain: "ads.example.com"},
+		{client: "10.2.9.9", domain: "tracker.example.com"},
+		{client: "10.2.9.9", domain: "global.example.com", blocked: true},
+		{client: "203.0.113.1", domain: "ads.example.com", blocked: true},
+		{client: "203.0.113.1", domain: "tracker.example.com", blocked: true},
+		{client: "203.0.113.1", domain: "infra.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.client+" "+tt.domain, func(t *testing.T) {
+			client := &net.UDPAddr{IP: net.ParseIP(tt.client), Port: 5353}
+			if rcode := solveFrom(t, p, tt.domain, client); (rcode == dnsmessage.RCodeNameError) != tt.blocked {
+				t.Errorf("answer to %s = %v, want blocked %v", tt.client, rcode, tt.blocked)
+			}
+		})
+	}
+}
+
+func cidr(t *testing.T, value string) *net.IPNet {
+	t.Helper()
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return network
+}
+
+// solveFrom sends an A query for the domain from the client over UDP and returns the RCode of the answer.
+func solveFrom(t *testing.T, p proxy.Service, domain string, client net.Addr) dnsmessage.RCode {
+	t.Helper()
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 7, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(domain + "."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	request, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := p.SolveUDP(request, client)
+	if err != nil {
+		t.Fatalf("SolveUDP() error = %v", err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	return msg.Header.RCode
+}
@@ -0,0 +1,149 @@
+package blocklist
+
+import (
+	"dns-proxy/pkg/domain/denylist"
+	"dns-proxy/pkg/domain/proxy"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Importer loads blocklists into the denylist, tagging every entry with the name of its list.
+type Importer struct {
+	denier   denylist.Service
+	sources  map[string]string
+	interval time.Duration
+	client   *http.Client
+	log      proxy.Logger
+}
+
+// New returns an Importer for the sources, a map of list names to locations. A location is either an
+// HTTP(S) URL or a file path.
+func New(denier denylist.Service, sources map[string]string, interval time.Duration, logger proxy.Logger) *Importer {
+	return &Importer{
+		denier:   denier,
+		sources:  sources,
+		interval: interval,
+		client:   &http.Client{Timeout: time.Minute},
+		log:      logger,
+	}
+}
+
+// Refresh imports all the sources and imports them again every interval.
+func (i *Importer) Refresh() {
+	i.importAll()
+	if i.interval <= 0 {
+		return
+	}
+	for range time.Tick(i.interval) {
+		i.importAll()
+	}
+}
+
+func (i *Importer) importAll() {
+	for name, location := range i.sources {
+		if err := i.Import(name, location); err != nil {
+			i.log.Err("error importing blocklist %s: %v", name, err)
+		}
+	}
+}
+
+// Import synchronizes the denylist with the list: the rules that are new to the list are added, and the
+// rules the list no longer has are removed unless another list still has them. Entries added by hand are
+// never modified.
+func (i *Importer) Import(name, location string) error {
+	body, err := i.fetch(location)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	rules, err := Parse(body)
+	if err != nil {
+		return err
+	}
+
+	existing, err := i.denier.GetDeniedDomains()
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]denylist.Denied, len(existing))
+	for _, denied := range existing {
+		entries[denied.Domain] = denied
+	}
+
+	var added []denylist.Denied
+	listed := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		listed[rule] = true
+		denied, ok := entries[rule]
+		if !ok {
+			added = append(added, denylist.Denied{Domain: rule, Sources: []string{name}})
+			continue
+		}
+		if len(denied.Sources) == 0 || hasSource(denied, name) {
+			continue
+		}
+		denied.Sources = append(denied.Sources, name)
+		added = append(added, denied)
+	}
+
+	var removed []string
+	for _, denied := range existing {
+		if listed[denied.Domain] || !hasSource(denied, name) {
+			continue
+		}
+		denied.Sources = withoutSource(denied, name)
+		if len(denied.Sources) == 0 {
+			removed = append(removed, denied.Domain)
+			continue
+		}
+		added = append(added, denied)
+	}
+
+	if err := i.denier.AddDeniedDomains(added); err != nil {
+		return err
+	}
+	if err := i.denier.RemoveDeniedDomains(removed); err != nil {
+		return err
+	}
+	i.log.Info("Imported blocklist %s: %d rules, %d entries updated, %d removed", name, len(rules), len(added), len(removed))
+	return nil
+}
+
+// fetch opens the list from its URL or file path.
+func (i *Importer) fetch(location string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		return os.Open(location)
+	}
+	response, err := i.client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s fetching %s", response.Status, location)
+	}
+	return response.Body, nil
+}
+
+func hasSource(denied denylist.Denied, name string) bool {
+	for _, source := range denied.Sources {
+		if source == name {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutSource(denied denylist.Denied, name string) []string {
+	sources := make([]string, 0, len(denied.Sources))
+	for _, source := range denied.Sources {
+		if source != name {
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
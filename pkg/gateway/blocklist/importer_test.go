@@ -0,0 +1,148 @@
+package blocklist
+
+import (
+	"dns-proxy/pkg/domain/denylist"
+	"dns-proxy/pkg/gateway/logger"
+	"dns-proxy/pkg/gateway/repository"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// lists serves the blocklists of the test by path, letting the test change them between imports.
+type lists struct {
+	mx    sync.Mutex
+	files map[string]string
+}
+
+func (l *lists) set(path, content string) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.files[path] = content
+}
+
+func (l *lists) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	content, ok := l.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprint(w, content)
+}
+
+func TestImport(t *testing.T) {
+	served := &lists{files: map[string]string{}}
+	server := httptest.NewServer(served)
+	defer server.Close()
+
+	denier, err := denylist.NewService(repository.NewMemory(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Entries added by hand have no sources.
+	for _, domain := range []string{"manual.example.com", "ads.example.com"} {
+		if err := denier.AddDeniedDomain(denylist.Denied{Domain: domain}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	importer := New(denier, nil, 0, logger.New("TEST", false))
+
+	served.set("/a", "0.0.0.0 ads.example.com\n0.0.0.0 tracker.example.com\n0.0.0.0 shared.example.com\n")
+	served.set("/b", "||shared.example.com^\nshared.example.com\nother.example.com\n")
+	mustImport(t, importer, "a", server.URL+"/a")
+	mustImport(t, importer, "b", server.URL+"/b")
+	assertEntries(t, denier, map[string][]string{
+		"manual.example.com":    nil,
+		"ads.example.com":       nil,
+		"tracker.example.com":   {"a"},
+		"shared.example.com":    {"a", "b"},
+		"||shared.example.com^": {"b"},
+		"other.example.com":     {"b"},
+	})
+
+	// The rules dropped from a list lose its source, and are removed when no list has them anymore. Manual
+	// entries and the entries of other lists are left as they are.
+	served.set("/a", "0.0.0.0 tracker.example.com\n")
+	mustImport(t, importer, "a", server.URL+"/a")
+	assertEntries(t, denier, map[string][]string{
+		"manual.example.com":    nil,
+		"ads.example.com":       nil,
+		"tracker.example.com":   {"a"},
+		"shared.example.com":    {"b"},
+		"||shared.example.com^": {"b"},
+		"other.example.com":     {"b"},
+	})
+
+	served.set("/a", "# emptied\n")
+	mustImport(t, importer, "a", server.URL+"/a")
+	assertEntries(t, denier, map[string][]string{
+		"manual.example.com":    nil,
+		"ads.example.com":       nil,
+		"shared.example.com":    {"b"},
+		"||shared.example.com^": {"b"},
+		"other.example.com":     {"b"},
+	})
+
+	// A list that can't be fetched leaves the denylist untouched.
+	if err := importer.Import("b", server.URL+"/missing"); err == nil {
+		t.Error("Import() of a missing list succeeded")
+	}
+	if denied, _ := denier.GetDeniedDomain("other.example.com"); denied == nil {
+		t.Error("entry of list b removed after a failed import")
+	}
+}
+
+func TestImportFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte("0.0.0.0 ads.example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	denier, err := denylist.NewService(repository.NewMemory(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustImport(t, New(denier, nil, 0, logger.New("TEST", false)), "local", path)
+	assertEntries(t, denier, map[string][]string{"ads.example.com": {"local"}})
+}
+
+func mustImport(t *testing.T, importer *Importer, name, location string) {
+	t.Helper()
+	if err := importer.Import(name, location); err != nil {
+		t.Fatalf("Import(%s) error = %v", name, err)
+	}
+}
+
+// assertEntries checks the denylist holds exactly the domains, each one with its sources.
+func assertEntries(t *testing.T, denier denylist.Service, want map[string][]string) {
+	t.Helper()
+	entries, err := denier.GetDeniedDomains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]string, len(entries))
+	for _, denied := range entries {
+		sources := append([]string(nil), denied.Sources...)
+		sort.Strings(sources)
+		got[denied.Domain] = sources
+	}
+	if len(got) != len(want) {
+		t.Errorf("denylist has %d entries, want %d: %v", len(got), len(want), got)
+	}
+	for domain, sources := range want {
+		gotSources, ok := got[domain]
+		if !ok {
+			t.Errorf("%s missing from the denylist", domain)
+			continue
+		}
+		if fmt.Sprint(gotSources) != fmt.Sprint(sources) {
+			t.Errorf("%s has sources %v, want %v", domain, gotSources, sources)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package blocklist
+
+import (
+	"bufio"
+	"dns-proxy/pkg/domain/matcher"
+	"io"
+	"net"
+	"strings"
+)
+
+// localHosts are the names that hosts files map to local addresses and must never be blocked.
+var localHosts = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// Parse reads a blocklist and returns its rules without duplicates. Every line can use one of these formats:
+//   - Hosts files like the ones of Pi-hole or StevenBlack: '0.0.0.0 ads.example.com'.
+//   - Adblock Plus network rules: '||ads.example.com^'. Exceptions, element hiding rules and rules with
+//     options or paths are skipped, since they can't be applied to DNS.
+//   - Plain domains or wildcards: 'ads.example.com', '*.example.com'.
+//
+// Comments, regular expressions, addresses and lines that can't be read as host names are skipped.
+func Parse(r io.Reader) ([]string, error) {
+	seen := map[string]bool{}
+	rules := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		for _, rule := range parseLine(scanner.Text()) {
+			if seen[rule] {
+				continue
+			}
+			if _, err := matcher.Parse(rule); err != nil {
+				continue
+			}
+			seen[rule] = true
+			rules = append(rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// cosmeticSeparators separate the domains of Adblock Plus element hiding and scriptlet rules from what they
+// hide in the page. They don't block the domain, so their lines are skipped.
+var cosmeticSeparators = []string{"##", "#@#", "#?#", "#@?#", "#$#", "#@$#", "#%#", "#@%#"}
+
+func parseLine(line string) []string {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		return nil
+	}
+	// Lines starting with a slash are URL path rules of adblock lists, not regular expressions for domains.
+	if strings.HasPrefix(line, "/") {
+		return nil
+	}
+	for _, separator := range cosmeticSeparators {
+		if strings.Contains(line, separator) {
+			return nil
+		}
+	}
+	line = strings.ToLower(stripComment(line))
+	if line == "" || strings.HasPrefix(line, "@@") {
+		return nil
+	}
+
+	if strings.HasPrefix(line, "||") {
+		domain := strings.TrimSuffix(line[2:], "^")
+		if !isHostname(domain) {
+			return nil
+		}
+		return []string{"||" + domain + "^"}
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 1 {
+		// Plain domains, which can be wildcards, but not addresses: a list of domains with an address in it
+		// is more likely broken than meant to block the answers with the address.
+		if !isHostname(strings.TrimPrefix(fields[0], "*.")) {
+			return nil
+		}
+		return fields
+	}
+	if net.ParseIP(fields[0]) == nil {
+		return nil
+	}
+	var rules []string
+	for _, host := range fields[1:] {
+		host = strings.TrimSuffix(host, ".")
+		if localHosts[host] || !isHostname(host) {
+			continue
+		}
+		rules = append(rules, host)
+	}
+	return rules
+}
+
+// stripComment removes the comment of the line. A comment starts with a '#' at the beginning of the line or
+// after a space, since the '#' of the adblock rules is part of them.
+func stripComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		if line[i] == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return strings.TrimSpace(line[:i])
+		}
+	}
+	return line
+}
+
+// isHostname reports whether the name is a valid host name: labels of up to 63 letters, digits, hyphens
+// and underscores, not starting nor ending with a hyphen, and a last label that isn't a number, so
+// addresses aren't host names.
+func isHostname(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	labels := strings.Split(name, ".")
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return strings.Trim(labels[len(labels)-1], "0123456789") != ""
+}
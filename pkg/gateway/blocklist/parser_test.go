@@ -0,0 +1,90 @@
+package blocklist
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		list string
+		want []string
+	}{
+		{
+			name: "hosts",
+			list: "# StevenBlack hosts\n" +
+				"127.0.0.1 localhost\n" +
+				"::1 ip6-localhost ip6-loopback\n" +
+				"0.0.0.0 0.0.0.0\n" +
+				"0.0.0.0 ads.example.com\n" +
+				"127.0.0.1 tracker.example.com # inline comment\n" +
+				"0.0.0.0\tA.Example.NET b.example.net.\n",
+			want: []string{"ads.example.com", "tracker.example.com", "a.example.net", "b.example.net"},
+		},
+		{
+			name: "adblock",
+			list: "[Adblock Plus 2.0]\n" +
+				"! comment\n" +
+				"||ads.example.com^\n" +
+				"||tracker.example.com\n" +
+				"@@||allowed.example.com^\n" +
+				"||example.org^$third-party\n" +
+				"||example.org/path^\n" +
+				"/banner/*\n",
+			want: []string{"||ads.example.com^", "||tracker.example.com^"},
+		},
+		{
+			name: "plain",
+			list: "# domains\n" +
+				"\n" +
+				"ads.example.com\n" +
+				"  *.tracker.example.com  \n" +
+				"ads.example.com\n" +
+				"not a domain\n" +
+				"bad..example.com\n",
+			want: []string{"ads.example.com", "*.tracker.example.com"},
+		},
+		{
+			name: "element hiding",
+			list: "example.com##.ad-banner\n" +
+				"news.example.org#@#.promo\n" +
+				"example.net#?#div:-abp-has(.ad)\n" +
+				"example.net#$#abort-on-property-read ads\n" +
+				"##.sponsored\n" +
+				"||ads.example.com^ # the ads\n" +
+				"tracker.example.com#not-a-comment\n",
+			want: []string{"||ads.example.com^"},
+		},
+		{
+			name: "junk",
+			list: "&ad_type=\n" +
+				"-ad-banner.\n" +
+				"ads-.example.com\n" +
+				"10.0.0.1\n" +
+				"10.0.0.0/8\n" +
+				"2001:db8::1\n" +
+				"0.0.0.0 &ad_type= ads.example.com\n" +
+				"||.ads.example.org^\n" +
+				"_dmarc.example.com\n",
+			want: []string{"ads.example.com", "_dmarc.example.com"},
+		},
+		{
+			name: "empty",
+			list: "# nothing\n\n",
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tt.list))
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("Parse() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"strings"
+)
+
+// Eviction is the policy choosing the entries evicted when the cache is full.
+type Eviction string
+
+const (
+	// EvictionLRU evicts the least recently used entry.
+	EvictionLRU Eviction = "lru"
+	// EvictionLFU evicts the least frequently used entry.
+	EvictionLFU Eviction = "lfu"
+	// EvictionTinyLFU is W-TinyLFU: new entries go through a small LRU window, and only get into the main
+	// space if they are used more often than the entry they would evict there. It resists floods of names
+	// queried once, like the random subdomains of an attack.
+	EvictionTinyLFU Eviction = "tinylfu"
+)
+
+// ParseEviction reads an eviction policy name, case insensitive.
+func ParseEviction(eviction string) (Eviction, error) {
+	switch e := Eviction(strings.ToLower(eviction)); e {
+	case EvictionLRU, EvictionLFU, EvictionTinyLFU:
+		return e, nil
+	}
+	return "", fmt.Errorf("invalid cache eviction %q", eviction)
+}
+
+// evictionPolicy keeps the order in which the keys of the cache are evicted.
+type evictionPolicy interface {
+	// add records a new key.
+	add(key string)
+	// access records a hit of a key.
+	access(key string)
+	// remove forgets a key removed from the cache.
+	remove(key string)
+	// victim returns the key to evict, and false if there are no keys. The key must be removed after.
+	victim() (string, bool)
+}
+
+// newEvictionPolicy returns the policy for a cache of about capacity entries.
+func newEvictionPolicy(eviction Eviction, capacity int) evictionPolicy {
+	switch eviction {
+	case EvictionLFU:
+		return newLFU()
+	case EvictionTinyLFU:
+		return newTinyLFU(capacity)
+	}
+	return newLRU()
+}
+
+// lru keeps the keys sorted by last access, the most recent at the front.
+type lru struct {
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func newLRU() *lru {
+	return &lru{order: list.New(), elements: make(map[string]*list.Element)}
+}
+
+func (l *lru) add(key string) {
+	l.elements[key] = l.order.PushFront(key)
+}
+
+func (l *lru) access(key string) {
+	if e, ok := l.elements[key]; ok {
+		l.order.MoveToFront(e)
+	}
+}
+
+func (l *lru) remove(key string) {
+	if e, ok := l.elements[key]; ok {
+		l.order.Remove(e)
+		delete(l.elements, key)
+	}
+}
+
+func (l *lru) victim() (string, bool) {
+	e := l.order.Back()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(string), true
+}
+
+func (l *lru) len() int {
+	return l.order.Len()
+}
+
+// lfu keeps the keys in a heap by number of accesses. Ties are broken by age, so the oldest key goes first.
+type lfu struct {
+	items lfuHeap
+	index map[string]*lfuItem
+	tick  uint64
+}
+
+type lfuItem struct {
+	key   string
+	count uint64
+	tick  uint64
+	pos   int
+}
+
+func newLFU() *lfu {
+	return &lfu{index: make(map[string]*lfuItem)}
+}
+
+func (l *lfu) add(key string) {
+	l.tick++
+	item := &lfuItem{key: key, count: 1, tick: l.tick}
+	l.index[key] = item
+	heap.Push(&l.items, item)
+}
+
+func (l *lfu) access(key string) {
+	if item, ok := l.index[key]; ok {
+		l.tick++
+		item.count++
+		item.tick = l.tick
+		heap.Fix(&l.items, item.pos)
+	}
+}
+
+func (l *lfu) remove(key string) {
+	if item, ok := l.index[key]; ok {
+		heap.Remove(&l.items, item.pos)
+		delete(l.index, key)
+	}
+}
+
+func (l *lfu) victim() (string, bool) {
+	if len(l.items) == 0 {
+		return "", false
+	}
+	return l.items[0].key, true
+}
+
+// lfuHeap implements heap.Interface for lfu.
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].tick < h[j].tick
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos = i
+	h[j].pos = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	item := x.(*lfuItem)
+	item.pos = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
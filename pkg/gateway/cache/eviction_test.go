@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// LFU evicts the least used keys first, and the ones used longer ago among the keys used as much.
+func TestLFU(t *testing.T) {
+	l := newLFU()
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		l.add(key)
+	}
+	// Counts: a 1, b 3, c 2, d 2, e 1. d is used after c, and e added after a.
+	for _, key := range []string{"b", "c", "b", "d"} {
+		l.access(key)
+	}
+	var order []string
+	for {
+		victim, ok := l.victim()
+		if !ok {
+			break
+		}
+		order = append(order, victim)
+		l.remove(victim)
+	}
+	if want := []string{"a", "e", "c", "d", "b"}; !slices.Equal(order, want) {
+		t.Errorf("evicted %v, want %v", order, want)
+	}
+}
+
+// W-TinyLFU keeps the popular keys while a flood of keys used once goes through the cache, where LRU loses
+// them since they aren't used often enough to stay among the most recent ones.
+func TestTinyLFUFlood(t *testing.T) {
+	const capacity, hot = 200, 50
+	ratios := map[Eviction]float64{}
+	for _, eviction := range []Eviction{EvictionLRU, EvictionTinyLFU} {
+		s := newShard(eviction, capacity, 0, capacity)
+		removeAt := time.Now().Add(time.Hour)
+		// get looks the key up like the proxy, storing it on a miss.
+		get := func(key string) bool {
+			if _, ok := s.lookup(key); ok {
+				s.access(key)
+				return true
+			}
+			s.store(key, value{size: 1}, removeAt)
+			return false
+		}
+		for round := 0; round < 5; round++ {
+			for i := 0; i < hot; i++ {
+				get(fmt.Sprint("hot", i))
+			}
+		}
+		hits := 0
+		for i := 0; i < 50*capacity; i++ {
+			get(fmt.Sprint("flood", i))
+			// Each popular key is used again after more new keys than the cache holds.
+			if i%5 == 0 && get(fmt.Sprint("hot", i/5%hot)) {
+				hits++
+			}
+		}
+		ratios[eviction] = float64(hits) / float64(10*capacity)
+	}
+	if ratios[EvictionTinyLFU] < 0.9 || ratios[EvictionLRU] > 0.1 {
+		t.Errorf("hit ratio of the popular keys: tinylfu %.2f, lru %.2f, want over 0.9 for tinylfu", ratios[EvictionTinyLFU], ratios[EvictionLRU])
+	}
+}
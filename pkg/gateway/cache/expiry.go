@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"time"
+)
+
+// expiryItem is a key of a shard in its expiry heap.
+type expiryItem struct {
+	key        string
+	expiration time.Time
+	pos        int
+}
+
+// expiryHeap implements heap.Interface, keeping the key that expires first at the top, so expired entries
+// are found without scanning the whole shard.
+type expiryHeap []*expiryItem
+
+func (h expiryHeap) Len() int { return len(h) }
+
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiration.Before(h[j].expiration) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos = i
+	h[j].pos = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	item := x.(*expiryItem)
+	item.pos = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// expired returns the first key expired before now, and false if there is none.
+func (h expiryHeap) expired(now time.Time) (string, bool) {
+	if len(h) == 0 || !h[0].expiration.Before(now) {
+		return "", false
+	}
+	return h[0].key, true
+}
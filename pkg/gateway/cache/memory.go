@@ -4,74 +4,347 @@ import (
 	"crypto/sha256"
 	"dns-proxy/pkg/domain/proxy"
 	"fmt"
-	"sync"
+	"hash/maphash"
+	"runtime"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
 )
 
+const (
+	// entryOverhead is the approximate memory of an entry besides its key and its packed message: the value,
+	// the unpacked message and the bookkeeping of the map and of the eviction policy.
+	entryOverhead = 512
+	// defaultCapacity sizes the eviction policy when the cache is only limited by bytes.
+	defaultCapacity = 10000
+	// minShardEntries is the fewest entries a shard is sized for, so small caches aren't split in shards
+	// too small to evict the right entries.
+	minShardEntries = 128
+	// shardsPerCPU sets the default number of shards.
+	shardsPerCPU = 4
+	// prefetchShare is the part of the TTL of an answer, in percent, left when it's prefetched.
+	prefetchShare = 10
+)
+
 type value struct {
 	msg        *dnsmessage.Message
+	stored     time.Time
 	expiration time.Time
+	negative   bool
+	size       int
+	expiry     *expiryItem
+	usage      *usage
+}
+
+// usage counts the hits of an entry to find the popular ones worth prefetching.
+type usage struct {
+	hits       atomic.Uint64
+	prefetched atomic.Bool
 }
 
 type Cache struct {
-	enabled bool
-	ttl     time.Duration
-	mx      sync.Mutex
-	log     proxy.Logger
-	items   map[string]value
+	enabled        bool
+	minTTL         time.Duration
+	maxTTL         time.Duration
+	maxNegativeTTL time.Duration
+	staleWindow    time.Duration
+	staleTTL       time.Duration
+	prefetchHits   uint64
+	log            proxy.Logger
+	seed           maphash.Seed
+	shards         []*shard
 }
 
-func New(ttl time.Duration, logger proxy.Logger, enabled bool) proxy.Cache {
+// New returns a cache keeping the messages as long as the lowest TTL of their records, but at least minTTL
+// and at most maxTTL. Negative answers are kept as RFC 2308 says, up to maxNegativeTTL. A maxTTL or
+// maxNegativeTTL of 0 doesn't limit the TTL.
+// Expired messages are kept for staleWindow more, to be served with a TTL of staleTTL when the resolver fails,
+// as RFC 8767 says. Messages with prefetchHits hits are prefetched shortly before they expire, 0 not to
+// prefetch.
+// The cache holds up to maxEntries messages taking about maxBytes of memory, evicting entries with the
+// eviction policy when it's full. A limit of 0 doesn't limit the cache.
+// The entries are split in shards by the hash of their question, each with its own lock and limits. With 0
+// shards there are a few per CPU.
+func New(minTTL, maxTTL, maxNegativeTTL, staleWindow, staleTTL time.Duration, prefetchHits int, eviction Eviction, maxEntries, maxBytes, shards int, logger proxy.Logger, enabled bool) proxy.Cache {
+	n := shardCount(shards, maxEntries)
+	capacity := defaultCapacity
+	if maxEntries > 0 {
+		capacity = maxEntries
+	}
 	cache := &Cache{
-		ttl:     ttl,
-		items:   map[string]value{},
-		log:     logger,
-		enabled: enabled,
+		minTTL:         minTTL,
+		maxTTL:         maxTTL,
+		maxNegativeTTL: maxNegativeTTL,
+		staleWindow:    staleWindow,
+		staleTTL:       staleTTL,
+		prefetchHits:   uint64(max(prefetchHits, 0)),
+		log:            logger,
+		enabled:        enabled,
+		seed:           maphash.MakeSeed(),
+		shards:         make([]*shard, n),
+	}
+	for i := range cache.shards {
+		cache.shards[i] = newShard(eviction, ceilDiv(maxEntries, n), ceilDiv(maxBytes, n), ceilDiv(capacity, n))
 	}
 	return cache
 }
 
+// shardCount returns the number of shards of the cache: the one configured, or a few per CPU, in both cases
+// rounded up to a power of 2 and lowered if the shards would hold less than minShardEntries each.
+func shardCount(shards, maxEntries int) int {
+	if shards <= 0 {
+		shards = shardsPerCPU * runtime.NumCPU()
+	}
+	n := 1
+	for n < shards {
+		n *= 2
+	}
+	for n > 1 && maxEntries > 0 && maxEntries/n < minShardEntries {
+		n /= 2
+	}
+	return n
+}
+
+// ceilDiv divides a limit among n shards, rounding up so the shards together hold at least the limit.
+func ceilDiv(limit, n int) int {
+	return (limit + n - 1) / n
+}
+
+// Flush removes the expired entries every second. The shards keep their entries in a heap by expiration, so
+// only the expired ones are visited.
 func (c *Cache) Flush() {
 	for now := range time.Tick(time.Second) {
-		for key, value := range c.items {
-			if value.expiration.Before(now) {
-				c.mx.Lock()
+		for _, s := range c.shards {
+			for _, key := range s.expire(now) {
 				c.log.Info("Clearing entry: %v \n", key)
-				delete(c.items, key)
-				c.mx.Unlock()
 			}
 		}
 	}
 }
 
-func (c *Cache) Get(msg dnsmessage.Message) (*dnsmessage.Message, error) {
+// Get returns a copy of the cached message with the TTLs of its records lowered by the time it has been
+// cached, so clients don't keep the records longer than their owners set. Expired messages within the stale
+// window are returned as stale with the stale TTL.
+func (c *Cache) Get(msg dnsmessage.Message) (*dnsmessage.Message, proxy.CacheState, error) {
 	if !c.enabled {
-		return nil, nil
+		return nil, proxy.CacheMiss, nil
 	}
-	c.mx.Lock()
-	defer c.mx.Unlock()
 	c.log.Debug("Looking for record: %v \n", msg.Questions[0].Name)
-	if value, ok := c.items[hasher(msg)]; ok {
+	now := time.Now()
+	key := hasher(msg)
+	s := c.shard(key)
+	value, ok := s.lookup(key)
+	switch {
+	case ok && now.Before(value.expiration):
 		c.log.Debug("Found record: %v \n", msg.Questions[0].Name)
-		return value.msg, nil
+		s.access(key)
+		s.hits.Add(1)
+		if value.negative {
+			s.negativeHits.Add(1)
+		}
+		state := proxy.CacheHit
+		if c.shouldPrefetch(value, now) {
+			s.prefetches.Add(1)
+			state = proxy.CachePrefetch
+		}
+		return withElapsedTTL(value.msg, now.Sub(value.stored)), state, nil
+	case ok && now.Before(value.expiration.Add(c.staleWindow)):
+		c.log.Debug("Found stale record: %v \n", msg.Questions[0].Name)
+		s.misses.Add(1)
+		s.stale.Add(1)
+		return withTTL(value.msg, c.staleTTL), proxy.CacheStale, nil
 	}
 	c.log.Debug("Record: %v not found", msg.Questions[0].Name)
-	return nil, nil
+	s.misses.Add(1)
+	return nil, proxy.CacheMiss, nil
+}
+
+// shouldPrefetch counts a hit of the entry and reports whether it's popular and in the last part of its TTL,
+// so it should be refreshed before it expires. It reports true once per entry.
+func (c *Cache) shouldPrefetch(value value, now time.Time) bool {
+	if c.prefetchHits == 0 || value.usage.hits.Add(1) < c.prefetchHits {
+		return false
+	}
+	if value.expiration.Sub(now) > value.expiration.Sub(value.stored)*prefetchShare/100 {
+		return false
+	}
+	return value.usage.prefetched.CompareAndSwap(false, true)
+}
+
+func (c *Cache) Stats() proxy.CacheStats {
+	var stats proxy.CacheStats
+	for _, s := range c.shards {
+		entries, bytes := s.usage()
+		stats.Entries += entries
+		stats.Bytes += bytes
+		stats.Hits += s.hits.Load()
+		stats.Misses += s.misses.Load()
+		stats.NegativeHits += s.negativeHits.Load()
+		stats.Stale += s.stale.Load()
+		stats.Prefetches += s.prefetches.Load()
+		stats.Evictions += s.evictions.Load()
+	}
+	return stats
 }
 
 func (c *Cache) Store(msg dnsmessage.Message) error {
 	if !c.enabled {
 		return nil
 	}
-	c.mx.Lock()
-	c.log.Debug("Saving record: %v \n", msg.Questions[0].Name)
-	c.items[hasher(msg)] = value{&msg, time.Now().Add(c.ttl)}
-	c.mx.Unlock()
+	now := time.Now()
+	var ttl time.Duration
+	negative := isNegative(&msg)
+	switch {
+	case negative:
+		var ok bool
+		if ttl, ok = c.negativeTTL(&msg); !ok {
+			// Negative answers without SOA record are not cached, as RFC 2308 says.
+			return nil
+		}
+		msg.Authorities = withSOATTL(msg.Authorities, ttl)
+	case msg.Header.RCode == dnsmessage.RCodeSuccess:
+		ttl = c.ttl(&msg)
+	default:
+		// Failures like SERVFAIL are not cached, so the next query tries again.
+		return nil
+	}
+	key := hasher(msg)
+	c.log.Debug("Saving record: %v for %v\n", msg.Questions[0].Name, ttl)
+	entry := value{msg: &msg, stored: now, expiration: now.Add(ttl), negative: negative, size: size(key, &msg), usage: &usage{}}
+	c.shard(key).store(key, entry, entry.expiration.Add(c.staleWindow))
 	return nil
 }
 
+// shard returns the shard holding the key.
+func (c *Cache) shard(key string) *shard {
+	return c.shards[maphash.String(c.seed, key)&uint64(len(c.shards)-1)]
+}
+
+// size returns the approximate memory taken by an entry.
+func size(key string, msg *dnsmessage.Message) int {
+	packed, err := msg.Pack()
+	if err != nil {
+		return len(key) + entryOverhead
+	}
+	return len(key) + 2*len(packed) + entryOverhead
+}
+
+// isNegative reports whether the message is a negative answer: NXDOMAIN, or NODATA, a success without answers.
+func isNegative(msg *dnsmessage.Message) bool {
+	return msg.Header.RCode == dnsmessage.RCodeNameError ||
+		(msg.Header.RCode == dnsmessage.RCodeSuccess && len(msg.Answers) == 0)
+}
+
+// negativeTTL returns how long a negative answer is cached: the lowest of the TTL and the MINIMUM field of
+// the SOA record of the authority section, up to maxNegativeTTL. It's false if there is no SOA record.
+func (c *Cache) negativeTTL(msg *dnsmessage.Message) (time.Duration, bool) {
+	for _, r := range msg.Authorities {
+		soa, ok := r.Body.(*dnsmessage.SOAResource)
+		if !ok {
+			continue
+		}
+		ttl := r.Header.TTL
+		if soa.MinTTL < ttl {
+			ttl = soa.MinTTL
+		}
+		negativeTTL := time.Duration(ttl) * time.Second
+		if c.maxNegativeTTL > 0 && negativeTTL > c.maxNegativeTTL {
+			negativeTTL = c.maxNegativeTTL
+		}
+		return negativeTTL, true
+	}
+	return 0, false
+}
+
+// withSOATTL returns a copy of the authority records with the TTL of the SOA record set to the time the
+// negative answer is cached, so the clients don't cache it for longer.
+func withSOATTL(records []dnsmessage.Resource, ttl time.Duration) []dnsmessage.Resource {
+	authorities := make([]dnsmessage.Resource, len(records))
+	copy(authorities, records)
+	for i := range authorities {
+		if authorities[i].Header.Type == dnsmessage.TypeSOA {
+			authorities[i].Header.TTL = uint32(ttl / time.Second)
+		}
+	}
+	return authorities
+}
+
+// ttl returns how long the message is cached: the lowest TTL of its answer and authority records, clamped
+// between minTTL and maxTTL.
+func (c *Cache) ttl(msg *dnsmessage.Message) time.Duration {
+	var ttl time.Duration
+	found := false
+	for _, records := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities} {
+		for _, r := range records {
+			if d := time.Duration(r.Header.TTL) * time.Second; !found || d < ttl {
+				ttl, found = d, true
+			}
+		}
+	}
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	if ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	return ttl
+}
+
+// withElapsedTTL returns a copy of the message with the TTLs of its records lowered by elapsed, down to 0.
+// The TTL of the OPT record holds flags instead, so it's left as is.
+func withElapsedTTL(msg *dnsmessage.Message, elapsed time.Duration) *dnsmessage.Message {
+	response := *msg
+	seconds := uint32(elapsed / time.Second)
+	response.Answers = lowerTTL(msg.Answers, seconds)
+	response.Authorities = lowerTTL(msg.Authorities, seconds)
+	response.Additionals = lowerTTL(msg.Additionals, seconds)
+	return &response
+}
+
+// withTTL returns a copy of the message with the TTLs of its records set to ttl, except the OPT record.
+func withTTL(msg *dnsmessage.Message, ttl time.Duration) *dnsmessage.Message {
+	response := *msg
+	seconds := uint32(ttl / time.Second)
+	response.Answers = setTTL(msg.Answers, seconds)
+	response.Authorities = setTTL(msg.Authorities, seconds)
+	response.Additionals = setTTL(msg.Additionals, seconds)
+	return &response
+}
+
+func setTTL(records []dnsmessage.Resource, seconds uint32) []dnsmessage.Resource {
+	if records == nil {
+		return nil
+	}
+	set := make([]dnsmessage.Resource, len(records))
+	copy(set, records)
+	for i := range set {
+		if set[i].Header.Type != dnsmessage.TypeOPT {
+			set[i].Header.TTL = seconds
+		}
+	}
+	return set
+}
+
+func lowerTTL(records []dnsmessage.Resource, seconds uint32) []dnsmessage.Resource {
+	if records == nil {
+		return nil
+	}
+	lowered := make([]dnsmessage.Resource, len(records))
+	copy(lowered, records)
+	for i := range lowered {
+		if lowered[i].Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		if lowered[i].Header.TTL > seconds {
+			lowered[i].Header.TTL -= seconds
+		} else {
+			lowered[i].Header.TTL = 0
+		}
+	}
+	return lowered
+}
+
 func hasher(msg dnsmessage.Message) string {
 	h := sha256.New()
 	h.Write([]byte(fmt.Sprintf("%v", msg.Questions)))
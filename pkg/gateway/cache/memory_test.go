@@ -0,0 +1,389 @@
+package cache
+
+import (
+	"dns-proxy/pkg/domain/proxy"
+	"dns-proxy/pkg/gateway/logger"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// benchNames is the number of different names queried by the benchmarks, twice the entries the cache holds.
+const benchNames = 100000
+
+// The evictions of every shard add up in the stats.
+func TestStatsEvictions(t *testing.T) {
+	queries, answers := messages(4 * minShardEntries)
+	c := New(0, 0, time.Hour, 0, 0, 0, EvictionLRU, 2*minShardEntries, 0, 2, logger.New("TEST", false), true)
+	for _, answer := range answers {
+		if err := c.Store(answer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := c.Stats()
+	if int(stats.Evictions) != len(answers)-stats.Entries || stats.Entries > 2*minShardEntries {
+		t.Errorf("stats = %+v after storing %d answers in a cache of %d", stats, len(answers), 2*minShardEntries)
+	}
+	hits := 0
+	for _, query := range queries {
+		if msg, _, _ := c.Get(query); msg != nil {
+			hits++
+		}
+	}
+	if hits != stats.Entries {
+		t.Errorf("%d queries hit the cache, want one per entry, %d", hits, stats.Entries)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	tests := []struct {
+		name        string
+		answers     []uint32
+		authorities []uint32
+		minTTL      time.Duration
+		maxTTL      time.Duration
+		want        time.Duration
+	}{
+		{name: "lowest answer", answers: []uint32{300, 60, 120}, want: 60 * time.Second},
+		{name: "lowest authority", answers: []uint32{300}, authorities: []uint32{30}, want: 30 * time.Second},
+		{name: "max", answers: []uint32{86400}, maxTTL: time.Hour, want: time.Hour},
+		{name: "under max", answers: []uint32{60}, maxTTL: time.Hour, want: 60 * time.Second},
+		{name: "min", answers: []uint32{5}, minTTL: time.Minute, want: time.Minute},
+		{name: "min over max", answers: []uint32{5}, minTTL: time.Minute, maxTTL: 30 * time.Second, want: time.Minute},
+		{name: "zero", answers: []uint32{0, 300}, want: 0},
+		{name: "no records", minTTL: 10 * time.Second, want: 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Cache{minTTL: tt.minTTL, maxTTL: tt.maxTTL}
+			msg := &dnsmessage.Message{}
+			for _, ttl := range tt.answers {
+				msg.Answers = append(msg.Answers, record(dnsmessage.TypeA, ttl))
+			}
+			for _, ttl := range tt.authorities {
+				msg.Authorities = append(msg.Authorities, record(dnsmessage.TypeNS, ttl))
+			}
+			if got := c.ttl(msg); got != tt.want {
+				t.Errorf("ttl() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithElapsedTTL(t *testing.T) {
+	// The TTL of the OPT record holds the extended RCODE and flags, like DNSSEC OK.
+	const optFlags = 0x8000
+	msg := &dnsmessage.Message{
+		Answers:     []dnsmessage.Resource{record(dnsmessage.TypeA, 300), record(dnsmessage.TypeA, 100)},
+		Authorities: []dnsmessage.Resource{record(dnsmessage.TypeNS, 3600)},
+		Additionals: []dnsmessage.Resource{record(dnsmessage.TypeA, 60), record(dnsmessage.TypeOPT, optFlags)},
+	}
+	tests := []struct {
+		elapsed time.Duration
+		want    []uint32
+	}{
+		{elapsed: 0, want: []uint32{300, 100, 3600, 60, optFlags}},
+		{elapsed: 1500 * time.Millisecond, want: []uint32{299, 99, 3599, 59, optFlags}},
+		{elapsed: 100 * time.Second, want: []uint32{200, 0, 3500, 0, optFlags}},
+		{elapsed: 2 * time.Hour, want: []uint32{0, 0, 0, 0, optFlags}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.elapsed.String(), func(t *testing.T) {
+			if got := ttls(withElapsedTTL(msg, tt.elapsed)); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("TTLs = %v, want %v", got, tt.want)
+			}
+			if got := ttls(msg); fmt.Sprint(got) != fmt.Sprint([]uint32{300, 100, 3600, 60, optFlags}) {
+				t.Errorf("cached message changed to TTLs %v", got)
+			}
+		})
+	}
+}
+
+// The answers served from the cache have their TTLs lowered by the time they have been cached.
+func TestGetElapsedTTL(t *testing.T) {
+	queries, answers := messages(1)
+	c := New(0, 0, time.Hour, 0, 0, 0, EvictionLRU, 0, 0, 1, logger.New("TEST", false), true).(*Cache)
+	c.Store(answers[0])
+	age(c, queries[0], 600*time.Second)
+	msg, state, _ := c.Get(queries[0])
+	if state != proxy.CacheHit || msg == nil || msg.Answers[0].Header.TTL != 3000 {
+		t.Errorf("Get() = %v, %v, want the answer with TTL 3000", msg, state)
+	}
+}
+
+// record returns a record of the type with the TTL. Only the header matters to the TTLs.
+func record(typ dnsmessage.Type, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: typ, Class: dnsmessage.ClassINET, TTL: ttl},
+	}
+}
+
+// ttls returns the TTLs of the records of the message, in the order of its sections.
+func ttls(msg *dnsmessage.Message) []uint32 {
+	var ttls []uint32
+	for _, records := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for _, r := range records {
+			ttls = append(ttls, r.Header.TTL)
+		}
+	}
+	return ttls
+}
+
+func TestNegativeTTL(t *testing.T) {
+	tests := []struct {
+		name           string
+		ttl            uint32
+		minimum        uint32
+		maxNegativeTTL time.Duration
+		want           time.Duration
+	}{
+		{name: "minimum", ttl: 3600, minimum: 300, want: 300 * time.Second},
+		{name: "ttl", ttl: 60, minimum: 300, want: 60 * time.Second},
+		{name: "capped", ttl: 86400, minimum: 86400, maxNegativeTTL: time.Hour, want: time.Hour},
+		{name: "under cap", ttl: 900, minimum: 600, maxNegativeTTL: time.Hour, want: 600 * time.Second},
+		{name: "no cap", ttl: 86400, minimum: 86400, want: 86400 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Cache{maxNegativeTTL: tt.maxNegativeTTL}
+			msg := negative(dnsmessage.RCodeNameError, tt.ttl, tt.minimum)
+			if got, ok := c.negativeTTL(&msg); !ok || got != tt.want {
+				t.Errorf("negativeTTL() = %v, %v, want %v", got, ok, tt.want)
+			}
+		})
+	}
+	msg := negative(dnsmessage.RCodeNameError, 300, 300)
+	msg.Authorities = nil
+	if got, ok := (&Cache{}).negativeTTL(&msg); ok {
+		t.Errorf("negativeTTL() without SOA = %v, want none", got)
+	}
+}
+
+func TestStoreNegative(t *testing.T) {
+	withoutSOA := negative(dnsmessage.RCodeNameError, 300, 300)
+	withoutSOA.Authorities = nil
+	tests := []struct {
+		name   string
+		msg    dnsmessage.Message
+		cached bool
+		// soaTTL is the TTL of the SOA record of the cached answer.
+		soaTTL uint32
+	}{
+		{name: "NXDOMAIN", msg: negative(dnsmessage.RCodeNameError, 3600, 300), cached: true, soaTTL: 300},
+		{name: "NODATA", msg: negative(dnsmessage.RCodeSuccess, 60, 300), cached: true, soaTTL: 60},
+		{name: "capped", msg: negative(dnsmessage.RCodeNameError, 86400, 86400), cached: true, soaTTL: 3600},
+		{name: "without SOA", msg: withoutSOA},
+		{name: "SERVFAIL", msg: negative(dnsmessage.RCodeServerFailure, 300, 300)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(0, 0, time.Hour, 0, 0, 0, EvictionLRU, 0, 0, 1, logger.New("TEST", false), true)
+			var before uint32
+			if len(tt.msg.Authorities) > 0 {
+				before = tt.msg.Authorities[0].Header.TTL
+			}
+			if err := c.Store(tt.msg); err != nil {
+				t.Fatal(err)
+			}
+			query := dnsmessage.Message{Questions: tt.msg.Questions}
+			msg, _, _ := c.Get(query)
+			if !tt.cached {
+				if msg != nil {
+					t.Errorf("Get() = %v, want the answer not cached", msg)
+				}
+				return
+			}
+			if msg == nil || msg.Header.RCode != tt.msg.Header.RCode {
+				t.Fatalf("Get() = %v, want the negative answer", msg)
+			}
+			if ttl := msg.Authorities[0].Header.TTL; ttl != tt.soaTTL {
+				t.Errorf("SOA TTL = %d, want the time the answer is cached, %d", ttl, tt.soaTTL)
+			}
+			if ttl := tt.msg.Authorities[0].Header.TTL; ttl != before {
+				t.Errorf("SOA TTL of the message given to Store changed from %d to %d", before, ttl)
+			}
+			c.Get(query)
+			if stats := c.Stats(); stats.NegativeHits != 2 || stats.Hits != 2 {
+				t.Errorf("stats = %+v, want 2 negative hits", stats)
+			}
+		})
+	}
+}
+
+// Positive answers aren't negative hits.
+func TestNegativeHits(t *testing.T) {
+	queries, answers := messages(1)
+	c := New(0, 0, time.Hour, 0, 0, 0, EvictionLRU, 0, 0, 1, logger.New("TEST", false), true)
+	nxdomain := negative(dnsmessage.RCodeNameError, 300, 300)
+	c.Store(answers[0])
+	c.Store(nxdomain)
+	c.Get(queries[0])
+	c.Get(dnsmessage.Message{Questions: nxdomain.Questions})
+	c.Get(dnsmessage.Message{Questions: nxdomain.Questions})
+	if stats := c.Stats(); stats.Hits != 3 || stats.NegativeHits != 2 {
+		t.Errorf("stats = %+v, want 3 hits, 2 of them negative", stats)
+	}
+}
+
+// negative returns an answer without records for missing.example.com with the rcode and a SOA record with
+// the TTL and MINIMUM field.
+func negative(rcode dnsmessage.RCode, ttl, minimum uint32) dnsmessage.Message {
+	name := dnsmessage.MustNewName("missing.example.com.")
+	zone := dnsmessage.MustNewName("example.com.")
+	return dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RCode: rcode},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+		Authorities: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body: &dnsmessage.SOAResource{
+				NS:      dnsmessage.MustNewName("ns.example.com."),
+				MBox:    dnsmessage.MustNewName("hostmaster.example.com."),
+				Serial:  1,
+				Refresh: 3600,
+				Retry:   600,
+				Expire:  86400,
+				MinTTL:  minimum,
+			},
+		}},
+	}
+}
+
+// Expired answers are served stale with the stale TTL within the stale window, and missed after it.
+func TestGetStale(t *testing.T) {
+	queries, answers := messages(1)
+	c := New(0, 0, time.Hour, time.Hour, 30*time.Second, 0, EvictionLRU, 0, 0, 1, logger.New("TEST", false), true).(*Cache)
+	c.Store(answers[0])
+	age(c, queries[0], 3601*time.Second)
+
+	msg, state, _ := c.Get(queries[0])
+	if state != proxy.CacheStale || msg == nil || msg.Answers[0].Header.TTL != 30 {
+		t.Fatalf("Get() = %v, %v, want the stale answer with TTL 30", msg, state)
+	}
+	if stats := c.Stats(); stats.Stale != 1 || stats.Misses != 1 || stats.Hits != 0 {
+		t.Errorf("stats = %+v, want a stale miss", stats)
+	}
+	age(c, queries[0], time.Hour)
+	if msg, state, _ := c.Get(queries[0]); msg != nil || state != proxy.CacheMiss {
+		t.Errorf("Get() past the stale window = %v, %v, want a miss", msg, state)
+	}
+}
+
+// A popular answer in the last part of its TTL is prefetched once, and again once it's been refreshed.
+func TestGetPrefetch(t *testing.T) {
+	queries, answers := messages(1)
+	c := New(0, 0, time.Hour, 0, 0, 2, EvictionLRU, 0, 0, 1, logger.New("TEST", false), true).(*Cache)
+	for refresh := 0; refresh < 2; refresh++ {
+		c.Store(answers[0])
+		// Hits before the last 10% of the TTL don't prefetch, but count to make the answer popular.
+		var states []proxy.CacheState
+		for i := 0; i < 3; i++ {
+			_, state, _ := c.Get(queries[0])
+			states = append(states, state)
+		}
+		age(c, queries[0], 3500*time.Second)
+		for i := 0; i < 3; i++ {
+			_, state, _ := c.Get(queries[0])
+			states = append(states, state)
+		}
+		want := []proxy.CacheState{proxy.CacheHit, proxy.CacheHit, proxy.CacheHit, proxy.CachePrefetch, proxy.CacheHit, proxy.CacheHit}
+		if fmt.Sprint(states) != fmt.Sprint(want) {
+			t.Errorf("states = %v, want %v", states, want)
+		}
+	}
+	if stats := c.Stats(); stats.Prefetches != 2 {
+		t.Errorf("prefetches = %d, want 2", stats.Prefetches)
+	}
+}
+
+// age moves the cached answer of the query back in time by d, as if it had been stored d earlier.
+func age(c *Cache, query dnsmessage.Message, d time.Duration) {
+	key := hasher(query)
+	s := c.shard(key)
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	v := s.items[key]
+	v.stored = v.stored.Add(-d)
+	v.expiration = v.expiration.Add(-d)
+	s.items[key] = v
+}
+
+// BenchmarkCacheGet looks up names drawn from a Zipf distribution, like the queries of real clients, in a
+// full cache. Run it with -cpu 1,2,4,8 to see how the shards scale compared to a single one, the same as a
+// global lock.
+func BenchmarkCacheGet(b *testing.B) {
+	queries, answers := messages(benchNames)
+	for _, shards := range []int{1, 0} {
+		b.Run(shardsName(shards), func(b *testing.B) {
+			c := benchCache(shards)
+			for _, answer := range answers {
+				c.Store(answer)
+			}
+			var seed atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				zipf := newZipf(seed.Add(1))
+				for pb.Next() {
+					c.Get(queries[zipf.Uint64()])
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkCacheStore stores answers for names drawn from a Zipf distribution, evicting entries once the
+// cache is full.
+func BenchmarkCacheStore(b *testing.B) {
+	_, answers := messages(benchNames)
+	for _, shards := range []int{1, 0} {
+		b.Run(shardsName(shards), func(b *testing.B) {
+			c := benchCache(shards)
+			var seed atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				zipf := newZipf(seed.Add(1))
+				for pb.Next() {
+					c.Store(answers[zipf.Uint64()])
+				}
+			})
+		})
+	}
+}
+
+func benchCache(shards int) proxy.Cache {
+	return New(0, 0, time.Hour, 0, 0, 0, EvictionLRU, benchNames/2, 0, shards, logger.New("BENCH", false), true)
+}
+
+func shardsName(shards int) string {
+	if shards == 0 {
+		return "shards=auto"
+	}
+	return fmt.Sprintf("shards=%d", shards)
+}
+
+func newZipf(seed int64) *rand.Zipf {
+	return rand.NewZipf(rand.New(rand.NewSource(seed)), 1.1, 1, benchNames-1)
+}
+
+// messages returns the queries and the answers of n different names.
+func messages(n int) ([]dnsmessage.Message, []dnsmessage.Message) {
+	queries := make([]dnsmessage.Message, n)
+	answers := make([]dnsmessage.Message, n)
+	for i := range queries {
+		name := dnsmessage.MustNewName(fmt.Sprintf("host%d.example.com.", i))
+		question := dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+		queries[i] = dnsmessage.Message{Questions: []dnsmessage.Question{question}}
+		answers[i] = dnsmessage.Message{
+			Header:    dnsmessage.Header{Response: true},
+			Questions: []dnsmessage.Question{question},
+			Answers: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 3600},
+				Body:   &dnsmessage.AResource{A: [4]byte{10, 0, byte(i >> 8), byte(i)}},
+			}},
+		}
+	}
+	return queries, answers
+}
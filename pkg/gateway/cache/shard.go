@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shard holds a part of the entries of the cache, chosen by the hash of their keys, so queries for different
+// names don't wait on the same lock. Lookups only take the read lock. The eviction policy has its own lock,
+// and the hits are recorded in it only when it's free: under contention a few accesses are lost, which only
+// makes the policy slightly less accurate.
+type shard struct {
+	mx         sync.RWMutex
+	items      map[string]value
+	expiry     expiryHeap
+	bytes      int
+	maxEntries int
+	maxBytes   int
+
+	policyMx sync.Mutex
+	eviction evictionPolicy
+
+	hits         atomic.Uint64
+	misses       atomic.Uint64
+	negativeHits atomic.Uint64
+	stale        atomic.Uint64
+	prefetches   atomic.Uint64
+	evictions    atomic.Uint64
+}
+
+func newShard(eviction Eviction, maxEntries, maxBytes, capacity int) *shard {
+	return &shard{
+		items:      map[string]value{},
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		eviction:   newEvictionPolicy(eviction, capacity),
+	}
+}
+
+// lookup returns the entry of the key, expired or not.
+func (s *shard) lookup(key string) (value, bool) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	v, ok := s.items[key]
+	return v, ok
+}
+
+// access records a hit of the key in the eviction policy, unless the policy is busy.
+func (s *shard) access(key string) {
+	if s.policyMx.TryLock() {
+		s.eviction.access(key)
+		s.policyMx.Unlock()
+	}
+}
+
+// store saves the entry of the key, replacing the previous one, and evicts entries if the shard is over its
+// limits. The entry is removed at removeAt, once it has expired and can't be served stale anymore.
+func (s *shard) store(key string, v value, removeAt time.Time) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.policyMx.Lock()
+	defer s.policyMx.Unlock()
+	if old, ok := s.items[key]; ok {
+		s.bytes -= old.size
+		v.expiry = old.expiry
+		v.expiry.expiration = removeAt
+		heap.Fix(&s.expiry, v.expiry.pos)
+		s.eviction.access(key)
+	} else {
+		v.expiry = &expiryItem{key: key, expiration: removeAt}
+		heap.Push(&s.expiry, v.expiry)
+		s.eviction.add(key)
+	}
+	s.items[key] = v
+	s.bytes += v.size
+	for (s.maxEntries > 0 && len(s.items) > s.maxEntries) || (s.maxBytes > 0 && s.bytes > s.maxBytes) {
+		victim, ok := s.eviction.victim()
+		if !ok {
+			return
+		}
+		s.remove(victim)
+		s.evictions.Add(1)
+	}
+}
+
+// expire removes the entries expired before now and returns their keys.
+func (s *shard) expire(now time.Time) []string {
+	var expired []string
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.policyMx.Lock()
+	defer s.policyMx.Unlock()
+	for {
+		key, ok := s.expiry.expired(now)
+		if !ok {
+			return expired
+		}
+		s.remove(key)
+		expired = append(expired, key)
+	}
+}
+
+// remove deletes the entry of the key. It must be called with both locks held.
+func (s *shard) remove(key string) {
+	if v, ok := s.items[key]; ok {
+		s.bytes -= v.size
+		heap.Remove(&s.expiry, v.expiry.pos)
+		delete(s.items, key)
+	}
+	s.eviction.remove(key)
+}
+
+// usage returns the number of entries of the shard and their approximate memory.
+func (s *shard) usage() (int, int) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return len(s.items), s.bytes
+}
@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+)
+
+// The expiry heap removes the entries in the order they expire, whatever the order they were stored in, and
+// the entries stored again move to their new expiration.
+func TestShardExpireOrder(t *testing.T) {
+	s := newShard(EvictionLRU, 0, 0, defaultCapacity)
+	start := time.Now()
+	order := rand.New(rand.NewSource(1)).Perm(100)
+	for _, i := range order {
+		s.store(fmt.Sprint(i), value{size: 1}, start.Add(time.Duration(i)*time.Second))
+	}
+	// Entry 5 is stored again to expire last, and 90 to expire first.
+	s.store("5", value{size: 1}, start.Add(time.Hour))
+	s.store("90", value{size: 1}, start.Add(-time.Second))
+
+	var expired []string
+	for i := 0; i <= 100; i += 10 {
+		expired = append(expired, s.expire(start.Add(time.Duration(i)*time.Second+time.Millisecond))...)
+	}
+	want := []string{"90"}
+	for i := 0; i < 100; i++ {
+		if i != 5 && i != 90 {
+			want = append(want, fmt.Sprint(i))
+		}
+	}
+	if !slices.Equal(expired, want) {
+		t.Errorf("expired %v, want %v", expired, want)
+	}
+	if entries, bytes := s.usage(); entries != 1 || bytes != 1 {
+		t.Errorf("shard holds %d entries of %d bytes, want entry 5 only", entries, bytes)
+	}
+	if got := s.expire(start.Add(2 * time.Hour)); !slices.Equal(got, []string{"5"}) {
+		t.Errorf("expired %v, want [5]", got)
+	}
+	if s.expiry.Len() != 0 {
+		t.Errorf("expiry heap holds %d keys after all expired", s.expiry.Len())
+	}
+}
+
+func TestShardEvictions(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxEntries int
+		maxBytes   int
+		stored     int
+		evicted    []string
+	}{
+		{name: "unbounded", stored: 10},
+		{name: "entries", maxEntries: 3, stored: 5, evicted: []string{"0", "1"}},
+		// Entries take 10 bytes.
+		{name: "bytes", maxBytes: 45, stored: 6, evicted: []string{"0", "1"}},
+		{name: "both", maxEntries: 5, maxBytes: 35, stored: 6, evicted: []string{"0", "1", "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newShard(EvictionLRU, tt.maxEntries, tt.maxBytes, defaultCapacity)
+			removeAt := time.Now().Add(time.Hour)
+			for i := 0; i < tt.stored; i++ {
+				s.store(fmt.Sprint(i), value{size: 10}, removeAt)
+			}
+			if got := s.evictions.Load(); got != uint64(len(tt.evicted)) {
+				t.Errorf("evictions = %d, want %d", got, len(tt.evicted))
+			}
+			for _, key := range tt.evicted {
+				if _, ok := s.lookup(key); ok {
+					t.Errorf("entry %s not evicted", key)
+				}
+			}
+			if entries, _ := s.usage(); entries != tt.stored-len(tt.evicted) || s.expiry.Len() != entries {
+				t.Errorf("shard holds %d entries and %d expirations, want %d", entries, s.expiry.Len(), tt.stored-len(tt.evicted))
+			}
+			// Expired entries aren't evictions.
+			s.expire(removeAt.Add(time.Second))
+			if got := s.evictions.Load(); got != uint64(len(tt.evicted)) {
+				t.Errorf("evictions = %d after expiring the entries, want %d", got, len(tt.evicted))
+			}
+		})
+	}
+}
+
+// Storing an entry again replaces it without counting an eviction.
+func TestShardStoreAgain(t *testing.T) {
+	s := newShard(EvictionLRU, 2, 0, defaultCapacity)
+	removeAt := time.Now().Add(time.Hour)
+	for i := 0; i < 10; i++ {
+		s.store("a", value{size: 10}, removeAt)
+		s.store("b", value{size: 20}, removeAt)
+	}
+	if got := s.evictions.Load(); got != 0 {
+		t.Errorf("evictions = %d, want 0", got)
+	}
+	if entries, bytes := s.usage(); entries != 2 || bytes != 30 {
+		t.Errorf("shard holds %d entries of %d bytes, want 2 of 30", entries, bytes)
+	}
+}
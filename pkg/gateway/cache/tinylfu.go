@@ -0,0 +1,157 @@
+package cache
+
+import (
+	"hash/maphash"
+)
+
+const (
+	// windowShare and protectedShare are the parts of the capacity of the window and of the protected
+	// segment of the main space, in percent.
+	windowShare    = 1
+	protectedShare = 80
+	// sketchDepth is the number of rows of the count-min sketch.
+	sketchDepth = 4
+	// maxCount is the highest count of the sketch, the most 4 bits hold as in TinyLFU, though every counter
+	// takes a byte: telling popular keys apart doesn't need larger counts.
+	maxCount = 15
+)
+
+// tinyLFU is the W-TinyLFU policy. New keys enter an LRU window. The keys leaving the window enter the
+// probation segment of the main space, where a second access promotes them to the protected segment. When an
+// entry must be evicted, the last key that left the window, the candidate, competes with the victim of the
+// probation segment, and the one estimated to be less frequently used by the sketch is evicted.
+type tinyLFU struct {
+	window     *lru
+	probation  *lru
+	protected  *lru
+	windowCap  int
+	protectCap int
+	candidate  string
+	sketch     *countMinSketch
+}
+
+func newTinyLFU(capacity int) *tinyLFU {
+	windowCap := capacity * windowShare / 100
+	if windowCap < 1 {
+		windowCap = 1
+	}
+	return &tinyLFU{
+		window:     newLRU(),
+		probation:  newLRU(),
+		protected:  newLRU(),
+		windowCap:  windowCap,
+		protectCap: (capacity - windowCap) * protectedShare / 100,
+		sketch:     newCountMinSketch(capacity),
+	}
+}
+
+func (t *tinyLFU) add(key string) {
+	t.sketch.increment(key)
+	t.window.add(key)
+	if t.window.len() > t.windowCap {
+		candidate, _ := t.window.victim()
+		t.window.remove(candidate)
+		t.probation.add(candidate)
+		t.candidate = candidate
+	}
+}
+
+func (t *tinyLFU) access(key string) {
+	t.sketch.increment(key)
+	switch {
+	case t.window.elements[key] != nil:
+		t.window.access(key)
+	case t.probation.elements[key] != nil:
+		t.probation.remove(key)
+		t.protected.add(key)
+		if t.protected.len() > t.protectCap {
+			demoted, _ := t.protected.victim()
+			t.protected.remove(demoted)
+			t.probation.add(demoted)
+		}
+	case t.protected.elements[key] != nil:
+		t.protected.access(key)
+	}
+}
+
+func (t *tinyLFU) remove(key string) {
+	t.window.remove(key)
+	t.probation.remove(key)
+	t.protected.remove(key)
+	if key == t.candidate {
+		t.candidate = ""
+	}
+}
+
+func (t *tinyLFU) victim() (string, bool) {
+	victim, ok := t.probation.victim()
+	if !ok {
+		if victim, ok = t.protected.victim(); !ok {
+			return t.window.victim()
+		}
+	}
+	if t.candidate != "" && t.candidate != victim && t.probation.elements[t.candidate] != nil {
+		candidate := t.candidate
+		t.candidate = ""
+		if t.sketch.estimate(candidate) <= t.sketch.estimate(victim) {
+			return candidate, true
+		}
+	}
+	return victim, true
+}
+
+// countMinSketch estimates the number of accesses of the keys in little memory. The counts are halved
+// every time the sketch sees ten times its width of accesses, so old popularity fades out.
+type countMinSketch struct {
+	rows      [sketchDepth][]uint8
+	seeds     [sketchDepth]maphash.Seed
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+func newCountMinSketch(capacity int) *countMinSketch {
+	width := 16
+	for width < capacity {
+		width *= 2
+	}
+	s := &countMinSketch{mask: uint64(width - 1), resetAt: 10 * width}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+		s.seeds[i] = maphash.MakeSeed()
+	}
+	return s
+}
+
+func (s *countMinSketch) increment(key string) {
+	for i := range s.rows {
+		counter := &s.rows[i][maphash.String(s.seeds[i], key)&s.mask]
+		if *counter < maxCount {
+			*counter++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		s.reset()
+	}
+}
+
+func (s *countMinSketch) estimate(key string) uint8 {
+	min := uint8(maxCount)
+	for i := range s.rows {
+		if count := s.rows[i][maphash.String(s.seeds[i], key)&s.mask]; count < min {
+			min = count
+		}
+	}
+	return min
+}
+
+// reset halves all the counts.
+func (s *countMinSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] /= 2
+		}
+	}
+	s.additions /= 2
+}
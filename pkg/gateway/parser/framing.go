@@ -0,0 +1,60 @@
+package parser
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MinMsgSize is the size of the header of a DNS message, so the smallest valid message.
+const MinMsgSize = 12
+
+// ShortReadError is returned for TCP messages shorter than their length prefix, as when the stream ends, or
+// fails, in the middle of a message. Messages can be up to 65535 bytes, the most the 2 bytes length prefix
+// can tell.
+type ShortReadError struct {
+	// Expected is the size of the message with its length prefix, or 2 if the prefix itself was cut.
+	Expected int
+	// Read is the number of bytes read before the stream ended.
+	Read int
+	// Err is the error that ended the read, nil for messages already in memory.
+	Err error
+}
+
+func (e *ShortReadError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("short read: got %d of %d bytes", e.Read, e.Expected)
+	}
+	return fmt.Sprintf("short read: got %d of %d bytes: %v", e.Read, e.Expected, e.Err)
+}
+
+func (e *ShortReadError) Unwrap() error {
+	return e.Err
+}
+
+// ReadTCPMsg reads the next message of a TCP stream, where messages come one after another each with its
+// length prefix. The message is returned with the prefix, in buf when it fits. It's shared by the TCP
+// controller reading the queries and the resolvers reading the responses. A stream that ends between
+// messages returns io.EOF, one that ends in the middle of a message a *ShortReadError.
+func ReadTCPMsg(r io.Reader, buf []byte) ([]byte, error) {
+	var prefix [2]byte
+	if n, err := io.ReadFull(r, prefix[:]); err != nil {
+		if n == 0 {
+			return nil, err
+		}
+		return nil, &ShortReadError{Expected: 2, Read: n, Err: err}
+	}
+	length := int(binary.BigEndian.Uint16(prefix[:]))
+	if length < MinMsgSize {
+		return nil, fmt.Errorf("invalid message length %d", length)
+	}
+	if cap(buf) < 2+length {
+		buf = make([]byte, 2+length)
+	}
+	message := buf[:2+length]
+	copy(message, prefix[:])
+	if n, err := io.ReadFull(r, message[2:]); err != nil {
+		return nil, &ShortReadError{Expected: 2 + length, Read: 2 + n, Err: err}
+	}
+	return message, nil
+}
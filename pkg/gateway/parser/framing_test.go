@@ -0,0 +1,74 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// message returns a message of size bytes, without counting the prefix, framed with its length prefix.
+func message(size int) []byte {
+	framed := append([]byte{byte(size >> 8), byte(size)}, make([]byte, size)...)
+	for i := range framed[2:] {
+		framed[2+i] = byte(i)
+	}
+	return framed
+}
+
+func TestReadTCPMsg(t *testing.T) {
+	first, second := message(MinMsgSize), message(4096)
+	stream := bytes.NewReader(append(append([]byte(nil), first...), second...))
+
+	buf := make([]byte, 512)
+	got, err := ReadTCPMsg(stream, buf)
+	if err != nil || !bytes.Equal(got, first) {
+		t.Fatalf("ReadTCPMsg() = %v, %v, want the first message", got, err)
+	}
+	if &got[0] != &buf[0] {
+		t.Error("ReadTCPMsg() didn't use the buffer the message fits in")
+	}
+	// Messages larger than the buffer get their own.
+	got, err = ReadTCPMsg(stream, buf)
+	if err != nil || !bytes.Equal(got, second) {
+		t.Fatalf("ReadTCPMsg() = %d bytes, %v, want the second message of %d bytes", len(got), err, len(second))
+	}
+	if _, err := ReadTCPMsg(stream, buf); err != io.EOF {
+		t.Errorf("ReadTCPMsg() at the end of the stream error = %v, want io.EOF", err)
+	}
+}
+
+func TestReadTCPMsgShort(t *testing.T) {
+	framed := message(MinMsgSize)
+	tests := []struct {
+		name     string
+		stream   []byte
+		expected int
+	}{
+		{name: "cut prefix", stream: framed[:1], expected: 2},
+		{name: "cut message", stream: framed[:len(framed)-1], expected: len(framed)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadTCPMsg(bytes.NewReader(tt.stream), nil)
+			var short *ShortReadError
+			if !errors.As(err, &short) {
+				t.Fatalf("ReadTCPMsg() error = %v, want a *ShortReadError", err)
+			}
+			if short.Expected != tt.expected || short.Read != len(tt.stream) || !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("ReadTCPMsg() error = %+v, want %d of %d bytes read", short, len(tt.stream), tt.expected)
+			}
+		})
+	}
+	// A length shorter than a DNS header can't be a message.
+	if _, err := ReadTCPMsg(bytes.NewReader(message(MinMsgSize-1)), nil); err == nil {
+		t.Error("ReadTCPMsg() of a message shorter than a header succeeded")
+	}
+}
+
+func TestTCPMsgToDNSShort(t *testing.T) {
+	var short *ShortReadError
+	if _, err := NewDNSParser().TCPMsgToDNS(message(MinMsgSize)[:5]); !errors.As(err, &short) {
+		t.Errorf("TCPMsgToDNS() error = %v, want a *ShortReadError", err)
+	}
+}
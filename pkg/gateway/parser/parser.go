@@ -2,12 +2,20 @@ package parser
 
 import (
 	"dns-proxy/pkg/domain/proxy"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 
 	"golang.org/x/net/dns/dnsmessage"
 )
 
+// maxTCPMsgSize is the largest message the 2 bytes length prefix of TCP can frame.
+const maxTCPMsgSize = 65535
+
+// ErrMsgTooLarge is returned for messages too large for the length prefix of TCP.
+var ErrMsgTooLarge = errors.New("message too large for tcp")
+
 type dnsParser struct{}
 
 func NewDNSParser() proxy.DNSParser {
@@ -15,10 +23,6 @@ func NewDNSParser() proxy.DNSParser {
 }
 
 func (p *dnsParser) DNSToMsg(dnsm *dnsmessage.Message, protocol string) ([]byte, error) {
-	message, err := dnsm.Pack()
-	if err != nil {
-		return nil, err
-	}
 	if protocol == proxy.SocketTCP {
 		//	https://www.ietf.org/rfc/rfc1035.txt
 		//	4.2.2. TCP usage
@@ -27,14 +31,18 @@ func (p *dnsParser) DNSToMsg(dnsm *dnsmessage.Message, protocol string) ([]byte,
 		//	length, excluding the two byte length field.  This length field allows
 		//	the low-level processing to assemble a complete message before beginning
 		//	to parse it.
-		var prefixBytesTCP []byte
-		prefixBytesTCP = make([]byte, 2)
-		prefixBytesTCP[0] = 0
-		prefixBytesTCP[1] = byte(len(message))
-		message = append(prefixBytesTCP, message...)
+		// The message is packed after the two bytes reserved for the prefix, so it isn't copied.
+		message, err := dnsm.AppendPack(make([]byte, 2, 514))
+		if err != nil {
+			return nil, err
+		}
+		if len(message)-2 > maxTCPMsgSize {
+			return nil, ErrMsgTooLarge
+		}
+		binary.BigEndian.PutUint16(message, uint16(len(message)-2))
 		return message, nil
 	} else if protocol == proxy.SocketUDP {
-		return message, nil
+		return dnsm.Pack()
 	} else {
 		return nil, errors.New("invalid msg format")
 	}
@@ -50,11 +58,23 @@ func (p *dnsParser) UDPMsgToDNS(m []byte) (*dnsmessage.Message, error) {
 }
 
 func (p *dnsParser) TCPMsgToDNS(m []byte) (*dnsmessage.Message, error) {
+	if len(m) < 2 {
+		return nil, &ShortReadError{Expected: 2, Read: len(m)}
+	}
+	length := int(binary.BigEndian.Uint16(m))
+	if len(m)-2 < length {
+		return nil, &ShortReadError{Expected: 2 + length, Read: len(m)}
+	}
 	var dnsm dnsmessage.Message
-	// Unpack the mesage starting from the second position.
-	err := dnsm.Unpack(m[2:])
+	// Unpack the message after the length prefix, ignoring anything past its length.
+	err := dnsm.Unpack(m[2 : 2+length])
 	if err != nil {
 		return nil, fmt.Errorf("unable to unpack tcp message: %s", err)
 	}
 	return &dnsm, nil
 }
+
+// ReadTCPMsg reads the next message of a TCP stream, see the ReadTCPMsg function.
+func (p *dnsParser) ReadTCPMsg(r io.Reader, buf []byte) ([]byte, error) {
+	return ReadTCPMsg(r, buf)
+}
@@ -0,0 +1,67 @@
+package parser
+
+import (
+	"bytes"
+	"dns-proxy/pkg/domain/proxy"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// The length prefix takes both bytes for the messages over 255 bytes, like the answers with large TXT records.
+func TestDNSToMsgRoundTrip(t *testing.T) {
+	p := NewDNSParser()
+	for _, size := range []int{10, 200, 1000, 60000} {
+		msg := txtAnswer(size)
+		framed, err := p.DNSToMsg(msg, proxy.SocketTCP)
+		if err != nil {
+			t.Fatalf("DNSToMsg() of %d bytes of TXT error = %v", size, err)
+		}
+		if length := int(binary.BigEndian.Uint16(framed)); length != len(framed)-2 {
+			t.Fatalf("length prefix = %d, want %d", length, len(framed)-2)
+		}
+		read, err := ReadTCPMsg(bytes.NewReader(framed), nil)
+		if err != nil {
+			t.Fatalf("ReadTCPMsg() error = %v", err)
+		}
+		got, err := p.TCPMsgToDNS(read)
+		if err != nil {
+			t.Fatalf("TCPMsgToDNS() error = %v", err)
+		}
+		if got.Header.ID != msg.Header.ID || len(got.Answers) != len(msg.Answers) {
+			t.Errorf("round trip of %d bytes of TXT = %+v, want %+v", size, got.Header, msg.Header)
+		}
+		udp, err := p.DNSToMsg(msg, proxy.SocketUDP)
+		if err != nil || !bytes.Equal(udp, framed[2:]) {
+			t.Errorf("UDP message differs from the TCP one without its prefix: %v", err)
+		}
+	}
+}
+
+func TestDNSToMsgTooLarge(t *testing.T) {
+	if _, err := NewDNSParser().DNSToMsg(txtAnswer(70000), proxy.SocketTCP); !errors.Is(err, ErrMsgTooLarge) {
+		t.Errorf("DNSToMsg() error = %v, want ErrMsgTooLarge", err)
+	}
+}
+
+// txtAnswer returns an answer carrying size bytes of text in TXT records.
+func txtAnswer(size int) *dnsmessage.Message {
+	name := dnsmessage.MustNewName("example.com.")
+	msg := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 0xbeef, Response: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}},
+	}
+	for size > 0 {
+		// A character string holds up to 255 bytes.
+		n := min(size, 255)
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.TXTResource{TXT: []string{strings.Repeat("a", n)}},
+		})
+		size -= n
+	}
+	return msg
+}
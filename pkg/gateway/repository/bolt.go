@@ -0,0 +1,201 @@
+package repository
+
+import (
+	"dns-proxy/pkg/domain/allowlist"
+	"dns-proxy/pkg/domain/denylist"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	deniedBucket  = []byte("denylist")
+	allowedBucket = []byte("allowlist")
+)
+
+// Bolt is a file-backed implementation of the denylist.Repository and allowlist.Repository interfaces.
+// Entries are stored as JSON in a bbolt database, one bucket per list keyed by domain, so they survive restarts.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// NewBolt opens the database at path, creating the file and its buckets if they don't exist.
+func NewBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{deniedBucket, allowedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Bolt{db: db}, nil
+}
+
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+func (b *Bolt) AddDeniedDomain(denied denylist.Denied) error {
+	value, err := json.Marshal(denied)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deniedBucket).Put([]byte(denied.Domain), value)
+	})
+}
+
+// AddDeniedDomains stores all the entries in a single transaction.
+func (b *Bolt) AddDeniedDomains(denied []denylist.Denied) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(deniedBucket)
+		for _, d := range denied {
+			value, err := json.Marshal(d)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(d.Domain), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *Bolt) RemoveDeniedDomain(domain string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(deniedBucket)
+		if bucket.Get([]byte(domain)) == nil {
+			return denylist.ErrNotFound
+		}
+		return bucket.Delete([]byte(domain))
+	})
+}
+
+// RemoveDeniedDomains deletes all the domains in a single transaction.
+func (b *Bolt) RemoveDeniedDomains(domains []string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(deniedBucket)
+		for _, domain := range domains {
+			if err := bucket.Delete([]byte(domain)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *Bolt) GetDeniedDomain(domain string) (*denylist.Denied, error) {
+	var denied *denylist.Denied
+	err := b.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(deniedBucket).Get([]byte(domain))
+		if value == nil {
+			return nil
+		}
+		denied = &denylist.Denied{}
+		return json.Unmarshal(value, denied)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return denied, nil
+}
+
+func (b *Bolt) GetDeniedDomains() ([]denylist.Denied, error) {
+	response := []denylist.Denied{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deniedBucket).ForEach(func(_, value []byte) error {
+			var denied denylist.Denied
+			if err := json.Unmarshal(value, &denied); err != nil {
+				return err
+			}
+			response = append(response, denied)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (b *Bolt) AddAllowedDomain(allowed allowlist.Allowed) error {
+	value, err := json.Marshal(allowed)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(allowedBucket).Put([]byte(allowed.Domain), value)
+	})
+}
+
+// AddAllowedDomains stores all the entries in a single transaction.
+func (b *Bolt) AddAllowedDomains(allowed []allowlist.Allowed) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(allowedBucket)
+		for _, a := range allowed {
+			value, err := json.Marshal(a)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(a.Domain), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *Bolt) RemoveAllowedDomain(domain string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(allowedBucket)
+		if bucket.Get([]byte(domain)) == nil {
+			return allowlist.ErrNotFound
+		}
+		return bucket.Delete([]byte(domain))
+	})
+}
+
+func (b *Bolt) GetAllowedDomain(domain string) (*allowlist.Allowed, error) {
+	var allowed *allowlist.Allowed
+	err := b.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(allowedBucket).Get([]byte(domain))
+		if value == nil {
+			return nil
+		}
+		allowed = &allowlist.Allowed{}
+		return json.Unmarshal(value, allowed)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return allowed, nil
+}
+
+func (b *Bolt) GetAllowedDomains() ([]allowlist.Allowed, error) {
+	response := []allowlist.Allowed{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(allowedBucket).ForEach(func(_, value []byte) error {
+			var allowed allowlist.Allowed
+			if err := json.Unmarshal(value, &allowed); err != nil {
+				return err
+			}
+			response = append(response, allowed)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
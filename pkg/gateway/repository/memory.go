@@ -0,0 +1,121 @@
+package repository
+
+import (
+	"dns-proxy/pkg/domain/allowlist"
+	"dns-proxy/pkg/domain/denylist"
+	"sync"
+)
+
+// Memory is an in-memory implementation of the denylist.Repository and allowlist.Repository interfaces.
+// Entries are lost on restart.
+type Memory struct {
+	mx      sync.RWMutex
+	denied  map[string]denylist.Denied
+	allowed map[string]allowlist.Allowed
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		denied:  map[string]denylist.Denied{},
+		allowed: map[string]allowlist.Allowed{},
+	}
+}
+
+func (m *Memory) AddDeniedDomain(denied denylist.Denied) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.denied[denied.Domain] = denied
+	return nil
+}
+
+func (m *Memory) AddDeniedDomains(denied []denylist.Denied) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	for _, d := range denied {
+		m.denied[d.Domain] = d
+	}
+	return nil
+}
+
+func (m *Memory) RemoveDeniedDomain(domain string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if _, ok := m.denied[domain]; !ok {
+		return denylist.ErrNotFound
+	}
+	delete(m.denied, domain)
+	return nil
+}
+
+func (m *Memory) RemoveDeniedDomains(domains []string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	for _, domain := range domains {
+		delete(m.denied, domain)
+	}
+	return nil
+}
+
+func (m *Memory) GetDeniedDomain(domain string) (*denylist.Denied, error) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	if denied, ok := m.denied[domain]; ok {
+		return &denied, nil
+	}
+	return nil, nil
+}
+
+func (m *Memory) GetDeniedDomains() ([]denylist.Denied, error) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	response := make([]denylist.Denied, 0, len(m.denied))
+	for _, denied := range m.denied {
+		response = append(response, denied)
+	}
+	return response, nil
+}
+
+func (m *Memory) AddAllowedDomain(allowed allowlist.Allowed) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.allowed[allowed.Domain] = allowed
+	return nil
+}
+
+func (m *Memory) AddAllowedDomains(allowed []allowlist.Allowed) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	for _, a := range allowed {
+		m.allowed[a.Domain] = a
+	}
+	return nil
+}
+
+func (m *Memory) RemoveAllowedDomain(domain string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if _, ok := m.allowed[domain]; !ok {
+		return allowlist.ErrNotFound
+	}
+	delete(m.allowed, domain)
+	return nil
+}
+
+func (m *Memory) GetAllowedDomain(domain string) (*allowlist.Allowed, error) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	if allowed, ok := m.allowed[domain]; ok {
+		return &allowed, nil
+	}
+	return nil, nil
+}
+
+func (m *Memory) GetAllowedDomains() ([]allowlist.Allowed, error) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	response := make([]allowlist.Allowed, 0, len(m.allowed))
+	for _, allowed := range m.allowed {
+		response = append(response, allowed)
+	}
+	return response, nil
+}
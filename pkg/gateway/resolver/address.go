@@ -0,0 +1,96 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Protocols spoken with the DNS Providers.
+const (
+	ProtocolTLS   = "tls"
+	ProtocolTCP   = "tcp"
+	ProtocolUDP   = "udp"
+	ProtocolHTTPS = "https"
+	ProtocolQUIC  = "quic"
+)
+
+// defaultDoHPath is the path of the DNS over HTTPS endpoint when the address doesn't have one.
+const defaultDoHPath = "/dns-query"
+
+// defaultPorts are the ports of the protocols.
+var defaultPorts = map[string]int{
+	ProtocolTLS:   853,
+	ProtocolTCP:   53,
+	ProtocolUDP:   53,
+	ProtocolHTTPS: 443,
+	ProtocolQUIC:  853,
+}
+
+// Address is the location of a DNS Provider, written as 'protocol://host:port'. The protocol is tls, the
+// default, tcp, udp, https or quic, and the port defaults to the one of the protocol. The name to verify the
+// certificate against and the SPKI pins go in the query, as in
+// 'tls://1.1.1.1?name=cloudflare-dns.com&pin=base64hash'. DNS over HTTPS addresses have the path of the
+// endpoint, '/dns-query' by default, and can choose the HTTP method, as in 'https://dns.google/dns-query?method=get'.
+type Address struct {
+	Protocol   string
+	Host       string
+	Port       int
+	ServerName string
+	Pins       []string
+	Path       string
+	Method     string
+}
+
+// ParseAddress reads the address of a DNS Provider.
+func ParseAddress(address string) (Address, error) {
+	if !strings.Contains(address, "://") {
+		address = "tls://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return Address{}, fmt.Errorf("invalid provider address %q: %w", address, err)
+	}
+	port, ok := defaultPorts[u.Scheme]
+	if !ok {
+		return Address{}, fmt.Errorf("invalid provider address %q: unsupported protocol %s", address, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return Address{}, fmt.Errorf("invalid provider address %q: missing host", address)
+	}
+	if u.Port() != "" {
+		port, err = strconv.Atoi(u.Port())
+		if err != nil {
+			return Address{}, fmt.Errorf("invalid provider address %q: invalid port", address)
+		}
+	}
+	query := u.Query()
+	a := Address{
+		Protocol:   u.Scheme,
+		Host:       u.Hostname(),
+		Port:       port,
+		ServerName: query.Get("name"),
+		Pins:       query["pin"],
+	}
+	if a.Protocol == ProtocolHTTPS {
+		a.Path = u.Path
+		if a.Path == "" {
+			a.Path = defaultDoHPath
+		}
+		a.Method = strings.ToUpper(query.Get("method"))
+		if a.Method == "" {
+			a.Method = http.MethodPost
+		}
+		if a.Method != http.MethodPost && a.Method != http.MethodGet {
+			return Address{}, fmt.Errorf("invalid provider address %q: invalid method %s", address, a.Method)
+		}
+	}
+	return a, nil
+}
+
+func (a Address) String() string {
+	return a.Protocol + "://" + net.JoinHostPort(a.Host, strconv.Itoa(a.Port)) + a.Path
+}
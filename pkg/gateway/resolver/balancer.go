@@ -0,0 +1,229 @@
+package resolver
+
+import (
+	"dns-proxy/pkg/domain/proxy"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Strategy is the order in which the DNS Providers are tried.
+type Strategy string
+
+const (
+	// StrategyStrict tries the providers in the configured order, so the others are only used on failover.
+	StrategyStrict Strategy = "strict"
+	// StrategyRoundRobin starts each query on the next provider.
+	StrategyRoundRobin Strategy = "round-robin"
+	// StrategyRandom starts each query on a random provider.
+	StrategyRandom Strategy = "random"
+	// StrategyFastest starts each query on the provider with the lowest average latency.
+	StrategyFastest Strategy = "fastest"
+)
+
+// ParseStrategy reads a strategy name, case insensitive.
+func ParseStrategy(strategy string) (Strategy, error) {
+	switch s := Strategy(strings.ToLower(strategy)); s {
+	case StrategyStrict, StrategyRoundRobin, StrategyRandom, StrategyFastest:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid provider strategy %q", strategy)
+}
+
+// Provider is the resolver of a DNS Provider, named by its address in the logs.
+type Provider struct {
+	Name     string
+	Resolver proxy.Resolver
+}
+
+// upstream keeps the health of a provider.
+type upstream struct {
+	Provider
+	mx      sync.Mutex
+	fails   int
+	ejected bool
+	// latency is the exponentially weighted moving average of the response times.
+	latency time.Duration
+}
+
+// balancer spreads the queries among several DNS Providers according to a strategy, and fails over to the
+// next one when a provider doesn't answer within timeOut. Providers that fail maxFails times in a row are
+// ejected and don't get queries until an active probe succeeds. If all of them are ejected, all of them are
+// tried.
+type balancer struct {
+	upstreams []*upstream
+	strategy  Strategy
+	maxFails  int
+	timeOut   time.Duration
+	next      uint32
+	probe     []byte
+	log       proxy.Logger
+}
+
+// NewBalancer returns a resolver over the providers. A provider that doesn't answer within timeOut counts as
+// failed, 0 to wait for it. Every probeInterval a query for the root name servers is sent to each provider to
+// measure its latency and bring back the ejected ones.
+func NewBalancer(providers []Provider, strategy Strategy, maxFails int, timeOut, probeInterval time.Duration, logger proxy.Logger) (proxy.Resolver, error) {
+	if len(providers) == 0 {
+		return nil, errors.New("no DNS Provider")
+	}
+	probe, err := probeQuery()
+	if err != nil {
+		return nil, err
+	}
+	b := &balancer{
+		strategy: strategy,
+		maxFails: maxFails,
+		timeOut:  timeOut,
+		probe:    probe,
+		log:      logger,
+	}
+	for _, p := range providers {
+		b.upstreams = append(b.upstreams, &upstream{Provider: p})
+	}
+	if probeInterval > 0 {
+		go b.probeAll(probeInterval)
+	}
+	return b, nil
+}
+
+func (b *balancer) Resolve(request []byte) ([]byte, error) {
+	var err error
+	for _, u := range b.order() {
+		var response []byte
+		start := time.Now()
+		response, err = b.attempt(u, request)
+		b.record(u, time.Since(start), err)
+		if err == nil {
+			return response, nil
+		}
+		b.log.Debug("could not resolve with %s: %v", u.Name, err)
+	}
+	return nil, err
+}
+
+// attempt resolves the request with the provider, giving up after the timeout so a provider that stalls
+// counts as failed and the query moves on to the next one. The resolution given up on ends on its own.
+func (b *balancer) attempt(u *upstream, request []byte) ([]byte, error) {
+	if b.timeOut <= 0 {
+		return u.Resolver.Resolve(request)
+	}
+	type result struct {
+		response []byte
+		err      error
+	}
+	// The request is copied since the caller may reuse it once the attempt is given up on.
+	request = append([]byte(nil), request...)
+	done := make(chan result, 1)
+	go func() {
+		response, err := u.Resolver.Resolve(request)
+		done <- result{response: response, err: err}
+	}()
+	timer := time.NewTimer(b.timeOut)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.response, r.err
+	case <-timer.C:
+		return nil, fmt.Errorf("%w after %v", errTimeOut, b.timeOut)
+	}
+}
+
+// order returns the providers in the order they are tried for a query, leaving out the ejected ones.
+func (b *balancer) order() []*upstream {
+	var healthy []*upstream
+	for _, u := range b.upstreams {
+		u.mx.Lock()
+		if !u.ejected {
+			healthy = append(healthy, u)
+		}
+		u.mx.Unlock()
+	}
+	if len(healthy) == 0 {
+		healthy = append(healthy, b.upstreams...)
+	}
+
+	switch b.strategy {
+	case StrategyRoundRobin:
+		start := int(atomic.AddUint32(&b.next, 1)-1) % len(healthy)
+		healthy = append(healthy[start:], healthy[:start]...)
+	case StrategyRandom:
+		rand.Shuffle(len(healthy), func(i, j int) { healthy[i], healthy[j] = healthy[j], healthy[i] })
+	case StrategyFastest:
+		latencies := make(map[*upstream]time.Duration, len(healthy))
+		for _, u := range healthy {
+			u.mx.Lock()
+			latencies[u] = u.latency
+			u.mx.Unlock()
+		}
+		sort.SliceStable(healthy, func(i, j int) bool { return latencies[healthy[i]] < latencies[healthy[j]] })
+	}
+	return healthy
+}
+
+// record updates the health of the provider with the result of a query.
+func (b *balancer) record(u *upstream, latency time.Duration, err error) {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	if err != nil {
+		u.fails++
+		if u.fails >= b.maxFails && !u.ejected {
+			u.ejected = true
+			b.log.Err("ejecting DNS Provider %s after %d failures: %v", u.Name, u.fails, err)
+		}
+		return
+	}
+	if u.ejected {
+		b.log.Info("DNS Provider %s is back", u.Name)
+	}
+	u.fails = 0
+	u.ejected = false
+	if u.latency == 0 {
+		u.latency = latency
+	} else {
+		u.latency = (7*u.latency + 3*latency) / 10
+	}
+}
+
+// probeAll sends the probe query to all the providers every interval.
+func (b *balancer) probeAll(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, u := range b.upstreams {
+			go func(u *upstream) {
+				start := time.Now()
+				_, err := b.attempt(u, b.probe)
+				b.record(u, time.Since(start), err)
+			}(u)
+		}
+	}
+}
+
+// probeQuery builds the query for the root name servers, with the length prefix of TCP.
+func probeQuery() ([]byte, error) {
+	b := dnsmessage.NewBuilder(make([]byte, 2, 514), dnsmessage.Header{RecursionDesired: true})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	err := b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName("."),
+		Type:  dnsmessage.TypeNS,
+		Class: dnsmessage.ClassINET,
+	})
+	if err != nil {
+		return nil, err
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(query, uint16(len(query)-2))
+	return query, nil
+}
@@ -0,0 +1,63 @@
+package resolver
+
+import (
+	"dns-proxy/pkg/gateway/logger"
+	"net"
+	"testing"
+	"time"
+)
+
+// A provider that accepts the queries but never answers is given up on after the timeout, and ejected once
+// it reaches maxFails so the next queries go straight to the healthy one.
+func TestBalancerStalledProvider(t *testing.T) {
+	stalled := stalledListener(t)
+	defer stalled.Close()
+	healthy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer healthy.Close()
+	go serveDNS(healthy)
+
+	const timeOut = 200 * time.Millisecond
+	const maxFails = 2
+	providers := []Provider{
+		// The read timeout of the stalled provider is longer than the test, only the balancer gives up on it.
+		{Name: "stalled", Resolver: NewTCP("127.0.0.1", port(stalled), 60000, 2, 1000)},
+		{Name: "healthy", Resolver: NewTCP("127.0.0.1", port(healthy), 1000, 2, 1000)},
+	}
+	r, err := NewBalancer(providers, StrategyStrict, maxFails, timeOut, time.Hour, logger.New("TEST", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := r.(*balancer)
+
+	for id := uint16(1); id <= maxFails+1; id++ {
+		start := time.Now()
+		response, err := r.Resolve(query(t, id, "example.com."))
+		elapsed := time.Since(start)
+		if err != nil {
+			t.Fatalf("Resolve() error = %v", err)
+		}
+		assertAnswer(t, response[2:], id)
+		if elapsed > 2*timeOut {
+			t.Errorf("query %d answered in %v with a timeout of %v", id, elapsed, timeOut)
+		}
+		if ejected := isEjected(b.upstreams[0]); ejected != (id >= maxFails) {
+			t.Errorf("after query %d stalled provider ejected = %v", id, ejected)
+		}
+		// Once ejected, the stalled provider isn't waited on anymore.
+		if id > maxFails && elapsed >= timeOut {
+			t.Errorf("query %d waited %v on the ejected provider", id, elapsed)
+		}
+	}
+	if isEjected(b.upstreams[1]) {
+		t.Error("healthy provider ejected")
+	}
+}
+
+func isEjected(u *upstream) bool {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	return u.ejected
+}
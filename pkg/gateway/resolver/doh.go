@@ -0,0 +1,97 @@
+package resolver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"dns-proxy/pkg/domain/proxy"
+	"dns-proxy/pkg/gateway/parser"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// dnsMessageType is the media type of the DNS messages in DNS over HTTPS.
+const dnsMessageType = "application/dns-message"
+
+// dohResolver speaks DNS over HTTPS, RFC 8484, for the networks where the port of DNS over TLS is blocked.
+// The requests go over HTTP/2 through the connections kept open by the transport.
+type dohResolver struct {
+	url    string
+	method string
+	client *http.Client
+}
+
+// NewDoH returns a resolver sending the queries to the endpoint at url with the method, GET or POST. Up to
+// poolSize idle connections are kept open for idleTimeOut milliseconds. The server is verified with
+// tlsConfig, see NewTLSConfig.
+func NewDoH(url, method string, readTimeOut uint, poolSize int, idleTimeOut uint, tlsConfig *tls.Config) proxy.Resolver {
+	return &dohResolver{
+		url:    url,
+		method: method,
+		client: &http.Client{
+			Timeout: time.Duration(readTimeOut) * time.Millisecond,
+			Transport: &http.Transport{
+				TLSClientConfig:     tlsConfig,
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: poolSize,
+				IdleConnTimeout:     time.Duration(idleTimeOut) * time.Millisecond,
+			},
+		},
+	}
+}
+
+// Resolve sends the request, given with the length prefix of TCP like to the other resolvers, without it.
+// The ID of the query is sent as 0, as RFC 8484 recommends so the responses can be cached by HTTP caches,
+// and the one of the request is put back on the response.
+func (r *dohResolver) Resolve(request []byte) ([]byte, error) {
+	if len(request) < 4 {
+		return nil, errors.New("request too short")
+	}
+	query := make([]byte, len(request)-2)
+	copy(query, request[2:])
+	query[0], query[1] = 0, 0
+
+	var req *http.Request
+	var err error
+	if r.method == http.MethodGet {
+		req, err = http.NewRequest(http.MethodGet, r.url+"?dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, r.url, bytes.NewReader(query))
+		if err == nil {
+			req.Header.Set("Content-Type", dnsMessageType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dnsMessageType)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not send request to DNS Provider %s: %w", r.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS Provider %s answered with status %s", r.url, resp.Status)
+	}
+	if contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); contentType != dnsMessageType {
+		return nil, fmt.Errorf("DNS Provider %s answered with content type %q", r.url, resp.Header.Get("Content-Type"))
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxUDPSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not read response from DNS Provider %s: %w", r.url, err)
+	}
+	if len(body) < parser.MinMsgSize || len(body) > maxUDPSize {
+		return nil, fmt.Errorf("invalid response size %d from DNS Provider %s", len(body), r.url)
+	}
+	response := make([]byte, 2, 2+len(body))
+	binary.BigEndian.PutUint16(response, uint16(len(body)))
+	response = append(response, body...)
+	copy(response[2:4], request[2:4])
+	return response, nil
+}
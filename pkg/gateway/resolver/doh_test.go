@@ -0,0 +1,112 @@
+package resolver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"dns-proxy/pkg/gateway/parser"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// dohProvider answers the DNS over HTTPS requests with serveDNS's answer, and fails the test on the requests
+// that don't follow RFC 8484.
+func dohProvider(t *testing.T, method string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			t.Errorf("request method = %s, want %s", r.Method, method)
+		}
+		if accept := r.Header.Get("Accept"); accept != dnsMessageType {
+			t.Errorf("request Accept = %q, want %s", accept, dnsMessageType)
+		}
+		var query []byte
+		var err error
+		if r.Method == http.MethodGet {
+			param := r.URL.Query().Get("dns")
+			if strings.ContainsAny(param, "=+/") {
+				t.Errorf("dns parameter %q isn't base64url without padding", param)
+			}
+			query, err = base64.RawURLEncoding.DecodeString(param)
+		} else {
+			if contentType := r.Header.Get("Content-Type"); contentType != dnsMessageType {
+				t.Errorf("request Content-Type = %q, want %s", contentType, dnsMessageType)
+			}
+			query, err = io.ReadAll(r.Body)
+		}
+		if err != nil {
+			t.Errorf("invalid query: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(query) >= 2 && (query[0] != 0 || query[1] != 0) {
+			t.Errorf("query ID on the wire = %d, want 0", int(query[0])<<8|int(query[1]))
+		}
+		response, err := answer(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Write(response)
+	}
+}
+
+func TestResolveDoH(t *testing.T) {
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		t.Run(method, func(t *testing.T) {
+			server := httptest.NewTLSServer(dohProvider(t, method))
+			defer server.Close()
+
+			r := NewDoH(server.URL+"/dns-query", method, 1000, 2, 1000, dohTLSConfig(server))
+			// The query of example.com isn't a multiple of 3 bytes long, so base64 would pad it.
+			for _, id := range []uint16{1, 2, 0xffff} {
+				response, err := r.Resolve(query(t, id, "example.com."))
+				if err != nil {
+					t.Fatalf("Resolve() error = %v", err)
+				}
+				assertAnswer(t, response[2:], id)
+			}
+		})
+	}
+}
+
+func TestResolveDoHInvalidResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{name: "status", handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", dnsMessageType)
+			w.WriteHeader(http.StatusBadGateway)
+		}},
+		{name: "content type", handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, "<html></html>")
+		}},
+		{name: "short body", handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", dnsMessageType)
+			w.Write(make([]byte, parser.MinMsgSize-1))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewTLSServer(tt.handler)
+			defer server.Close()
+
+			r := NewDoH(server.URL+"/dns-query", http.MethodPost, 1000, 2, 1000, dohTLSConfig(server))
+			if response, err := r.Resolve(query(t, 1, "example.com.")); err == nil {
+				t.Errorf("Resolve() = %v, want an error", response)
+			}
+		})
+	}
+}
+
+// dohTLSConfig trusts the certificate of the test server.
+func dohTLSConfig(server *httptest.Server) *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	return &tls.Config{RootCAs: roots}
+}
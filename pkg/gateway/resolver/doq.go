@@ -0,0 +1,129 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"dns-proxy/pkg/domain/proxy"
+	"dns-proxy/pkg/gateway/parser"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// doqALPN is the protocol negotiated by DNS over QUIC.
+	doqALPN = "doq"
+	// doqRequestCancelled is the error code of RFC 9250 used to cancel the streams of the queries given up on.
+	doqRequestCancelled = 0x3
+	// doqSessionCacheSize is the number of TLS sessions kept to resume connections with 0-RTT.
+	doqSessionCacheSize = 16
+)
+
+// doqResolver speaks DNS over QUIC, RFC 9250. All the queries share one connection, each one on its own
+// stream so a lost packet only delays its own query. Connections are resumed with 0-RTT when the provider
+// allows it, so the queries go out along with the handshake.
+type doqResolver struct {
+	address     string
+	readTimeOut uint
+	tlsConfig   *tls.Config
+	quicConfig  *quic.Config
+	mx          sync.Mutex
+	conn        *quic.Conn
+}
+
+// NewDoQ returns a resolver for the DNS over QUIC provider at ip and port. The connection is closed after
+// idleTimeOut milliseconds without queries. The provider is verified with tlsConfig, see NewTLSConfig.
+func NewDoQ(ip string, port int, readTimeOut uint, idleTimeOut uint, tlsConfig *tls.Config) proxy.Resolver {
+	config := tlsConfig.Clone()
+	config.NextProtos = []string{doqALPN}
+	config.ClientSessionCache = tls.NewLRUClientSessionCache(doqSessionCacheSize)
+	config.MinVersion = tls.VersionTLS13
+	return &doqResolver{
+		address:     net.JoinHostPort(ip, strconv.Itoa(port)),
+		readTimeOut: readTimeOut,
+		tlsConfig:   config,
+		quicConfig: &quic.Config{
+			MaxIdleTimeout: time.Duration(idleTimeOut) * time.Millisecond,
+		},
+	}
+}
+
+// Resolve sends the request on a new stream of the connection. If the connection was closed, as happens
+// when it was idle for too long, the request is retried once on a new one.
+func (r *doqResolver) Resolve(request []byte) ([]byte, error) {
+	if len(request) < 4 {
+		return nil, errors.New("request too short")
+	}
+	conn, err := r.getConn()
+	if err != nil {
+		return nil, err
+	}
+	response, err := r.exchange(conn, request)
+	if err != nil && conn.Context().Err() != nil {
+		conn, err = r.getConn()
+		if err != nil {
+			return nil, err
+		}
+		response, err = r.exchange(conn, request)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve with DNS Provider %s: %w", r.address, err)
+	}
+	return response, nil
+}
+
+// exchange writes the request on a stream and reads its response. The ID of the query must be 0, and the
+// one of the request is put back on the response. Both messages carry the 2 bytes length prefix.
+func (r *doqResolver) exchange(conn *quic.Conn, request []byte) ([]byte, error) {
+	timeOut := time.Duration(r.readTimeOut) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeOut)
+	defer cancel()
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SetDeadline(time.Now().Add(timeOut)); err != nil {
+		return nil, err
+	}
+	query := make([]byte, len(request))
+	copy(query, request)
+	query[2], query[3] = 0, 0
+	if _, err := stream.Write(query); err != nil {
+		stream.CancelRead(doqRequestCancelled)
+		return nil, err
+	}
+	// Closing the stream tells the provider the query is complete.
+	if err := stream.Close(); err != nil {
+		stream.CancelRead(doqRequestCancelled)
+		return nil, err
+	}
+	response, err := parser.ReadTCPMsg(stream, nil)
+	if err != nil {
+		stream.CancelRead(doqRequestCancelled)
+		return nil, err
+	}
+	copy(response[2:4], request[2:4])
+	return response, nil
+}
+
+// getConn returns the open connection, dialing a new one if it was closed.
+func (r *doqResolver) getConn() (*quic.Conn, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.conn != nil && r.conn.Context().Err() == nil {
+		return r.conn, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(r.readTimeOut)*time.Millisecond)
+	defer cancel()
+	conn, err := quic.DialAddrEarly(ctx, r.address, r.tlsConfig, r.quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	r.conn = conn
+	return conn, nil
+}
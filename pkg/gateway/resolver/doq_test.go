@@ -0,0 +1,164 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"dns-proxy/pkg/domain/proxy"
+	"dns-proxy/pkg/gateway/parser"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// doqProvider is a DNS over QUIC provider answering each stream with serveDNS's answer. It records the
+// connections, the streams and the IDs of the queries as they arrive.
+type doqProvider struct {
+	ln    *quic.Listener
+	roots *x509.CertPool
+	// stall makes the provider read the queries without answering them, until the client cancels the stream.
+	stall     bool
+	cancelled chan quic.StreamErrorCode
+	mx        sync.Mutex
+	conns     []*quic.Conn
+	streams   int
+	ids       []uint16
+}
+
+func newDoQProvider(t *testing.T, stall bool) *doqProvider {
+	t.Helper()
+	cert, roots := testCertificate(t)
+	ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{doqALPN}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &doqProvider{ln: ln, roots: roots, stall: stall, cancelled: make(chan quic.StreamErrorCode, 1)}
+	go p.serve()
+	return p
+}
+
+func (p *doqProvider) serve() {
+	for {
+		conn, err := p.ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		p.mx.Lock()
+		p.conns = append(p.conns, conn)
+		p.mx.Unlock()
+		go func() {
+			for {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				go p.handle(stream)
+			}
+		}()
+	}
+}
+
+func (p *doqProvider) handle(stream *quic.Stream) {
+	defer stream.Close()
+	request, err := parser.ReadTCPMsg(stream, nil)
+	if err != nil {
+		return
+	}
+	p.mx.Lock()
+	p.streams++
+	p.ids = append(p.ids, binary.BigEndian.Uint16(request[2:4]))
+	p.mx.Unlock()
+	if p.stall {
+		// The client stops reading the stream once it gives up, which cancels the stream with its error code.
+		<-stream.Context().Done()
+		var streamErr *quic.StreamError
+		if errors.As(context.Cause(stream.Context()), &streamErr) {
+			p.cancelled <- streamErr.ErrorCode
+		}
+		return
+	}
+	response, err := answer(request[2:])
+	if err != nil {
+		return
+	}
+	stream.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+}
+
+func (p *doqProvider) stats() (conns, streams int, ids []uint16) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return len(p.conns), p.streams, append([]uint16(nil), p.ids...)
+}
+
+// resolver returns a DNS over QUIC resolver trusting the provider.
+func (p *doqProvider) resolver(readTimeOut uint) proxy.Resolver {
+	return NewDoQ("127.0.0.1", p.ln.Addr().(*net.UDPAddr).Port, readTimeOut, 10000, &tls.Config{ServerName: "localhost", RootCAs: p.roots})
+}
+
+func TestResolveDoQ(t *testing.T) {
+	p := newDoQProvider(t, false)
+	defer p.ln.Close()
+
+	r := p.resolver(1000)
+	for id := uint16(1); id <= 3; id++ {
+		response, err := r.Resolve(query(t, id, "example.com."))
+		if err != nil {
+			t.Fatalf("Resolve() error = %v", err)
+		}
+		assertAnswer(t, response[2:], id)
+	}
+	conns, streams, ids := p.stats()
+	if conns != 1 || streams != 3 {
+		t.Errorf("queries sent on %d connections and %d streams, want 1 connection and 1 stream each", conns, streams)
+	}
+	for _, id := range ids {
+		if id != 0 {
+			t.Errorf("query ID on the wire = %d, want 0", id)
+		}
+	}
+}
+
+// The queries sent after the provider closes the connection go on a new one.
+func TestResolveDoQReconnect(t *testing.T) {
+	p := newDoQProvider(t, false)
+	defer p.ln.Close()
+
+	r := p.resolver(1000)
+	if _, err := r.Resolve(query(t, 1, "example.com.")); err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	p.mx.Lock()
+	p.conns[0].CloseWithError(0, "")
+	p.mx.Unlock()
+	response, err := r.Resolve(query(t, 2, "example.com."))
+	if err != nil {
+		t.Fatalf("Resolve() after the connection closed error = %v", err)
+	}
+	assertAnswer(t, response[2:], 2)
+	if conns, _, _ := p.stats(); conns != 2 {
+		t.Errorf("queries sent on %d connections, want 2", conns)
+	}
+}
+
+// A query given up on cancels its stream with DOQ_REQUEST_CANCELLED.
+func TestResolveDoQCancel(t *testing.T) {
+	p := newDoQProvider(t, true)
+	defer p.ln.Close()
+
+	if _, err := p.resolver(200).Resolve(query(t, 1, "example.com.")); err == nil {
+		t.Fatal("Resolve() of an unanswered query succeeded")
+	}
+	select {
+	case code := <-p.cancelled:
+		if code != doqRequestCancelled {
+			t.Errorf("stream cancelled with code %#x, want %#x", code, doqRequestCancelled)
+		}
+	case <-time.After(time.Second):
+		t.Error("stream not cancelled")
+	}
+}
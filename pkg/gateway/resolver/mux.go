@@ -0,0 +1,174 @@
+package resolver
+
+import (
+	"dns-proxy/pkg/gateway/parser"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxTimeOuts is the number of queries in a row that can time out on a connection without any response
+// read before it's closed as stalled.
+const maxTimeOuts = 3
+
+var (
+	errConnClosed = errors.New("connection to DNS Provider closed")
+	errTimeOut    = errors.New("timed out waiting for DNS Provider")
+	errStalled    = errors.New("DNS Provider stopped answering on the connection")
+)
+
+// muxConn sends many queries at once over a single connection, as RFC 7766 allows. The queries get a new ID
+// that is unique on the connection, and the responses, which can come in any order, are matched back by ID.
+type muxConn struct {
+	conn    net.Conn
+	writeMx sync.Mutex
+	mx      sync.Mutex
+	pending map[uint16]chan []byte
+	nextID  uint16
+	used    time.Time
+	// timeOuts counts the queries timed out since the last response was read.
+	timeOuts int
+	err      error
+}
+
+func newMuxConn(conn net.Conn) *muxConn {
+	m := &muxConn{
+		conn:    conn,
+		pending: make(map[uint16]chan []byte),
+		used:    time.Now(),
+	}
+	go m.read()
+	return m
+}
+
+// exchange sends the request, framed with the 2 bytes length prefix, and waits for its response. A query
+// that times out is forgotten without closing the connection, and its response is dropped if it comes later.
+// But once maxTimeOuts queries in a row time out without any response read, the provider is taken as not
+// answering on the connection anymore, and it's closed so the next queries go on a new one.
+func (m *muxConn) exchange(request []byte, timeOut time.Duration) ([]byte, error) {
+	if len(request) < 4 {
+		return nil, errors.New("request too short")
+	}
+	originalID := binary.BigEndian.Uint16(request[2:])
+	query := make([]byte, len(request))
+	copy(query, request)
+
+	m.mx.Lock()
+	if m.err != nil {
+		m.mx.Unlock()
+		return nil, m.err
+	}
+	if len(m.pending) > 0xffff {
+		m.mx.Unlock()
+		return nil, errors.New("too many queries in flight")
+	}
+	id := m.nextID
+	for m.pending[id] != nil {
+		id++
+	}
+	m.nextID = id + 1
+	reply := make(chan []byte, 1)
+	m.pending[id] = reply
+	m.used = time.Now()
+	m.mx.Unlock()
+
+	binary.BigEndian.PutUint16(query[2:], id)
+	m.writeMx.Lock()
+	err := m.conn.SetWriteDeadline(time.Now().Add(timeOut))
+	if err == nil {
+		_, err = m.conn.Write(query)
+	}
+	m.writeMx.Unlock()
+	if err != nil {
+		m.close(err)
+		return nil, m.closedErr()
+	}
+
+	timer := time.NewTimer(timeOut)
+	defer timer.Stop()
+	select {
+	case response, ok := <-reply:
+		if !ok {
+			return nil, m.closedErr()
+		}
+		binary.BigEndian.PutUint16(response[2:], originalID)
+		return response, nil
+	case <-timer.C:
+		m.mx.Lock()
+		delete(m.pending, id)
+		m.timeOuts++
+		stalled := m.timeOuts >= maxTimeOuts
+		m.mx.Unlock()
+		if stalled {
+			m.close(errStalled)
+		}
+		return nil, errTimeOut
+	}
+}
+
+// read delivers the responses to the queries waiting for them until the connection fails.
+func (m *muxConn) read() {
+	for {
+		response, err := parser.ReadTCPMsg(m.conn, nil)
+		if err != nil {
+			m.close(err)
+			return
+		}
+		id := binary.BigEndian.Uint16(response[2:])
+		m.mx.Lock()
+		m.timeOuts = 0
+		if reply, ok := m.pending[id]; ok {
+			reply <- response
+			delete(m.pending, id)
+		}
+		m.mx.Unlock()
+	}
+}
+
+// close closes the connection and fails the queries waiting on it with errConnClosed, wrapping the cause.
+func (m *muxConn) close(cause error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if m.err != nil {
+		return
+	}
+	m.err = errConnClosed
+	if cause != errConnClosed {
+		m.err = fmt.Errorf("%w: %w", errConnClosed, cause)
+	}
+	m.conn.Close()
+	for id, reply := range m.pending {
+		close(reply)
+		delete(m.pending, id)
+	}
+}
+
+// load returns the number of queries waiting for a response.
+func (m *muxConn) load() int {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return len(m.pending)
+}
+
+// closedErr returns the error the connection was closed with.
+func (m *muxConn) closedErr() error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return m.err
+}
+
+func (m *muxConn) closed() bool {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return m.err != nil
+}
+
+// idleSince reports whether the connection had no queries since t.
+func (m *muxConn) idleSince(t time.Time) bool {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return len(m.pending) == 0 && m.used.Before(t)
+}
@@ -0,0 +1,121 @@
+package resolver
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// healthCheckInterval is the time between checks of the idle connections.
+const healthCheckInterval = 5 * time.Second
+
+// pool keeps the connections to the DNS Provider open between queries, so they don't pay a TLS handshake
+// every time. Each connection carries many queries at once, and a new one is opened only when all of them
+// are busy, up to size. Connections closed by the provider are dropped, and the ones idle for longer than
+// idleTimeOut are closed.
+type pool struct {
+	mx      sync.Mutex
+	conns   []*muxConn
+	dialing int
+	dialed  *sync.Cond
+	// failures counts the failed dials, dialErr being the last error.
+	failures    uint64
+	dialErr     error
+	size        int
+	idleTimeOut time.Duration
+	dial        func() (net.Conn, error)
+}
+
+func newPool(size int, idleTimeOut time.Duration, dial func() (net.Conn, error)) *pool {
+	if size < 1 {
+		size = 1
+	}
+	p := &pool{
+		size:        size,
+		idleTimeOut: idleTimeOut,
+		dial:        dial,
+	}
+	p.dialed = sync.NewCond(&p.mx)
+	go p.healthCheck()
+	return p
+}
+
+// get returns the open connection with the fewest queries in flight. A new connection is opened when there
+// is none, or all of them are busy and the pool isn't full. When the pool is full of connections still being
+// opened, it waits for them.
+func (p *pool) get() (*muxConn, error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	var best *muxConn
+	for {
+		p.prune()
+		load := 0
+		best = nil
+		for _, conn := range p.conns {
+			if l := conn.load(); best == nil || l < load {
+				best, load = conn, l
+			}
+		}
+		full := len(p.conns)+p.dialing >= p.size
+		if best != nil && (load == 0 || full) {
+			return best, nil
+		}
+		if !full {
+			break
+		}
+		failures := p.failures
+		p.dialed.Wait()
+		// When the dials waited for fail and there is no connection, the error is returned rather than dialing
+		// again, so a provider that doesn't answer doesn't keep the queries waiting a timeout after another.
+		if p.failures != failures && len(p.conns) == 0 {
+			return nil, p.dialErr
+		}
+	}
+
+	p.dialing++
+	p.mx.Unlock()
+	conn, err := p.dial()
+	p.mx.Lock()
+	p.dialing--
+	p.dialed.Broadcast()
+	if err != nil {
+		p.failures++
+		p.dialErr = err
+		if best != nil {
+			return best, nil
+		}
+		return nil, err
+	}
+	m := newMuxConn(conn)
+	p.conns = append(p.conns, m)
+	return m, nil
+}
+
+// prune drops the closed connections. It must be called with the lock held.
+func (p *pool) prune() {
+	open := p.conns[:0]
+	for _, conn := range p.conns {
+		if !conn.closed() {
+			open = append(open, conn)
+		}
+	}
+	for i := len(open); i < len(p.conns); i++ {
+		p.conns[i] = nil
+	}
+	p.conns = open
+}
+
+// healthCheck closes periodically the connections that have been idle for too long.
+func (p *pool) healthCheck() {
+	for range time.Tick(healthCheckInterval) {
+		p.mx.Lock()
+		deadline := time.Now().Add(-p.idleTimeOut)
+		for _, conn := range p.conns {
+			if conn.idleSince(deadline) {
+				conn.close(errConnClosed)
+			}
+		}
+		p.prune()
+		p.mx.Unlock()
+	}
+}
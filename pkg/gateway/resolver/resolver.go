@@ -2,81 +2,87 @@ package resolver
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"dns-proxy/pkg/domain/proxy"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
 	"time"
 )
 
+// resolver sends the queries over pooled TCP connections, in plain DNS or, wrapped by tlsResolver, over TLS.
 type resolver struct {
 	dnsIP       string
 	port        int
 	readTimeOut uint
+	pool        *pool
 }
 
-func New(ip string, port int, readTimeOut uint) proxy.Resolver {
-	return &resolver{
+// tlsResolver is a resolver speaking DNS over TLS.
+type tlsResolver struct {
+	*resolver
+	tlsConfig *tls.Config
+}
+
+// New returns a resolver that opens up to poolSize connections to the DNS Provider, closing the ones idle for
+// longer than idleTimeOut milliseconds. The provider is verified with tlsConfig, see NewTLSConfig.
+func New(ip string, port int, readTimeOut uint, poolSize int, idleTimeOut uint, tlsConfig *tls.Config) proxy.TLSResolver {
+	r := &tlsResolver{
+		resolver: &resolver{
+			dnsIP:       ip,
+			port:        port,
+			readTimeOut: readTimeOut,
+		},
+		tlsConfig: tlsConfig,
+	}
+	r.pool = newPool(poolSize, time.Duration(idleTimeOut)*time.Millisecond, func() (net.Conn, error) {
+		return r.GetTLSConnection()
+	})
+	return r
+}
+
+// NewTCP returns a resolver like New that speaks plain DNS over TCP, for the DNS servers of internal networks.
+func NewTCP(ip string, port int, readTimeOut uint, poolSize int, idleTimeOut uint) proxy.Resolver {
+	r := &resolver{
 		dnsIP:       ip,
 		port:        port,
 		readTimeOut: readTimeOut,
 	}
+	r.pool = newPool(poolSize, time.Duration(idleTimeOut)*time.Millisecond, func() (net.Conn, error) {
+		return net.DialTimeout(proxy.SocketTCP, r.address(), time.Duration(readTimeOut)*time.Millisecond)
+	})
+	return r
 }
 
-func (r *resolver) GetTLSConnection() (*tls.Conn, error) {
-	certs, err := r.getRootsCA()
-	if err != nil {
-		return nil, err
-	}
-	roots := x509.NewCertPool()
-	for _, cert := range certs {
-		roots.AddCert(cert)
-	}
-	conn, err := tls.Dial(
-		proxy.SocketTCP, net.JoinHostPort(r.dnsIP, strconv.Itoa(r.port)),
-		&tls.Config{
-			RootCAs: roots,
-		})
-	if err != nil {
-		return nil, err
-	}
-	err = conn.SetReadDeadline(time.Now().Add(time.Duration(r.readTimeOut) * time.Millisecond))
-	if err != nil {
-		return nil, err
-	}
-	return conn, nil
+// GetTLSConnection opens a connection to the DNS Provider. The dial and the handshake together are bounded by
+// the read timeout, so a provider that accepts connections but stalls doesn't hold the queries waiting on it.
+func (r *tlsResolver) GetTLSConnection() (*tls.Conn, error) {
+	dialer := &net.Dialer{Timeout: time.Duration(r.readTimeOut) * time.Millisecond}
+	return tls.DialWithDialer(dialer, proxy.SocketTCP, r.address(), r.tlsConfig)
 }
 
+// Resolve sends the request through a pooled connection shared with other queries. If the connection fails,
+// as happens when the provider closed it, the request is retried once on another one.
 func (r *resolver) Resolve(request []byte) ([]byte, error) {
-	conn, err := r.GetTLSConnection()
+	timeOut := time.Duration(r.readTimeOut) * time.Millisecond
+	conn, err := r.pool.get()
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
-	_, e := conn.Write(request)
-	if e != nil {
-		return nil, fmt.Errorf("could not send request to DNS Provider %s", r.dnsIP)
+	response, err := conn.exchange(request, timeOut)
+	if errors.Is(err, errConnClosed) {
+		conn, err = r.pool.get()
+		if err != nil {
+			return nil, err
+		}
+		response, err = conn.exchange(request, timeOut)
 	}
-	var reply [2045]byte
-	n, err := conn.Read(reply[:])
 	if err != nil {
-		return nil, fmt.Errorf("could not read response from DNS Provider %s", r.dnsIP)
+		return nil, fmt.Errorf("could not resolve with DNS Provider %s: %w", r.dnsIP, err)
 	}
-	return reply[:n], nil
+	return response, nil
 }
 
-func (r *resolver) getRootsCA() ([]*x509.Certificate, error) {
-	// TODO: There's no need to go get the certs from the provider on every request.
-	// Create a cache for the certs and update them every now and then to give a faster response.
-	conn, err := tls.Dial(
-		proxy.SocketTCP,
-		net.JoinHostPort(r.dnsIP, strconv.Itoa(r.port)),
-		&tls.Config{
-			InsecureSkipVerify: true,
-		})
-	if err != nil {
-		return nil, err
-	}
-	return conn.ConnectionState().PeerCertificates, nil
+func (r *resolver) address() string {
+	return net.JoinHostPort(r.dnsIP, strconv.Itoa(r.port))
 }
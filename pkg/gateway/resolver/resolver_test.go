@@ -0,0 +1,268 @@
+package resolver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"dns-proxy/pkg/gateway/parser"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestResolveTLS(t *testing.T) {
+	cert, roots := testCertificate(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveDNS(ln)
+
+	r := New("127.0.0.1", port(ln), 1000, 2, 1000, &tls.Config{ServerName: "localhost", RootCAs: roots})
+	for id := uint16(1); id <= 3; id++ {
+		response, err := r.Resolve(query(t, id, "example.com."))
+		if err != nil {
+			t.Fatalf("Resolve() error = %v", err)
+		}
+		assertAnswer(t, response[2:], id)
+	}
+}
+
+// A provider that accepts the connections but never completes the handshake must not block the queries
+// for longer than the read timeout.
+func TestResolveTLSStalledHandshake(t *testing.T) {
+	ln := stalledListener(t)
+	defer ln.Close()
+
+	const timeOut = 300 * time.Millisecond
+	r := New("127.0.0.1", port(ln), uint(timeOut/time.Millisecond), 2, 1000, &tls.Config{ServerName: "localhost"})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			start := time.Now()
+			_, err := r.Resolve(query(t, id, "example.com."))
+			elapsed := time.Since(start)
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				t.Errorf("Resolve() error = %v, want a timeout", err)
+			}
+			// The queries waiting on the pool for the stalled dials fail with them.
+			if elapsed > 2*timeOut {
+				t.Errorf("Resolve() took %v with a read timeout of %v", elapsed, timeOut)
+			}
+		}(uint16(i))
+	}
+	wg.Wait()
+}
+
+// A connection on which the provider stops answering is closed after maxTimeOuts queries time out on it,
+// and the next queries go on a new one.
+func TestResolveStalledConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var mx sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mx.Lock()
+			conns = append(conns, conn)
+			first := len(conns) == 1
+			mx.Unlock()
+			go func() {
+				defer conn.Close()
+				for answered := 0; ; answered++ {
+					request, err := parser.ReadTCPMsg(conn, nil)
+					if err != nil {
+						return
+					}
+					// The first connection goes silent after its first answer, the others keep answering.
+					if first && answered > 0 {
+						continue
+					}
+					response, err := answer(request[2:])
+					if err != nil {
+						return
+					}
+					conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+				}
+			}()
+		}
+	}()
+
+	r := NewTCP("127.0.0.1", port(ln), 200, 2, 60000)
+	failed := 0
+	for id := uint16(1); id <= 10; id++ {
+		response, err := r.Resolve(query(t, id, "example.com."))
+		if err != nil {
+			if !errors.Is(err, errTimeOut) {
+				t.Fatalf("Resolve() error = %v, want a timeout", err)
+			}
+			failed++
+			continue
+		}
+		assertAnswer(t, response[2:], id)
+	}
+	mx.Lock()
+	dialed := len(conns)
+	mx.Unlock()
+	if failed != maxTimeOuts || dialed != 2 {
+		t.Errorf("%d of 10 queries failed on %d connections, want %d failed and a second connection", failed, dialed, maxTimeOuts)
+	}
+}
+
+// stalledListener accepts connections and never writes to them.
+func stalledListener(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	return ln
+}
+
+// serveDNS answers the queries of the connections accepted by the listener with an A record, see answer.
+func serveDNS(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				request, err := parser.ReadTCPMsg(conn, nil)
+				if err != nil {
+					return
+				}
+				response, err := answer(request[2:])
+				if err != nil {
+					return
+				}
+				prefixed := binary.BigEndian.AppendUint16(nil, uint16(len(response)))
+				if _, err := conn.Write(append(prefixed, response...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// answer builds the response to the query, without length prefix, with the A record 192.0.2.1.
+func answer(request []byte) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(request); err != nil {
+		return nil, err
+	}
+	msg.Header.Response = true
+	for _, q := range msg.Questions {
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		})
+	}
+	return msg.Pack()
+}
+
+// query builds an A query for the name with the length prefix of TCP.
+func query(t *testing.T, id uint16, name string) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, err := msg.AppendPack(make([]byte, 2, 514))
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint16(packed, uint16(len(packed)-2))
+	return packed
+}
+
+// assertAnswer checks the response, without length prefix, has the ID and the answer of serveDNS.
+func assertAnswer(t *testing.T, response []byte, id uint16) {
+	t.Helper()
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if msg.Header.ID != id {
+		t.Errorf("response ID = %d, want %d", msg.Header.ID, id)
+	}
+	if len(msg.Answers) != 1 || msg.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{192, 0, 2, 1} {
+		t.Errorf("response answers = %v, want 192.0.2.1", msg.Answers)
+	}
+}
+
+func port(ln net.Listener) int {
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// testCertificate returns a self-signed certificate for localhost and 127.0.0.1, and the pool trusting it.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
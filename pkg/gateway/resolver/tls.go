@@ -0,0 +1,60 @@
+package resolver
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// NewTLSConfig returns the TLS configuration used to verify the DNS Provider. Its certificate must be valid
+// for serverName and signed by the CAs in the PEM file at caFile, or by the system roots if it's empty.
+// pins are the base64 encoded SHA-256 hashes of the SubjectPublicKeyInfo of trusted keys, as in RFC 7858.
+// If there are pins, one of the certificates of the verified chain must match one of them.
+func NewTLSConfig(serverName, caFile string, pins []string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.RootCAs = roots
+	}
+	if len(pins) > 0 {
+		pinSet := make(map[string]bool, len(pins))
+		for _, pin := range pins {
+			hash, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("invalid SPKI pin %q", pin)
+			}
+			pinSet[string(hash)] = true
+		}
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyPins(state, pinSet)
+		}
+	}
+	return config, nil
+}
+
+// verifyPins checks that a certificate of the verified chains has one of the pinned keys.
+func verifyPins(state tls.ConnectionState, pins map[string]bool) error {
+	for _, chain := range state.VerifiedChains {
+		for _, cert := range chain {
+			hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			if pins[string(hash[:])] {
+				return nil
+			}
+		}
+	}
+	return errors.New("no certificate of the DNS Provider matches the SPKI pins")
+}
@@ -0,0 +1,99 @@
+package resolver
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	cert, _ := testCertificate(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveDNS(ln)
+
+	other, _ := testCertificate(t)
+	caFile, otherCAFile := writePEM(t, cert), writePEM(t, other)
+	pin, otherPin := spkiPin(cert), spkiPin(other)
+	tests := []struct {
+		name       string
+		serverName string
+		caFile     string
+		pins       []string
+		valid      bool
+	}{
+		{name: "trusted", serverName: "localhost", caFile: caFile, valid: true},
+		{name: "pinned", serverName: "localhost", caFile: caFile, pins: []string{otherPin, pin}, valid: true},
+		{name: "wrong server name", serverName: "dns.example.net", caFile: caFile},
+		{name: "untrusted CA", serverName: "localhost", caFile: otherCAFile},
+		{name: "untrusted CA pinned", serverName: "localhost", caFile: otherCAFile, pins: []string{pin}},
+		{name: "wrong pin", serverName: "localhost", caFile: caFile, pins: []string{otherPin}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := NewTLSConfig(tt.serverName, tt.caFile, tt.pins)
+			if err != nil {
+				t.Fatalf("NewTLSConfig() error = %v", err)
+			}
+			r := New("127.0.0.1", port(ln), 1000, 1, 1000, config)
+			response, err := r.Resolve(query(t, 1, "example.com."))
+			if !tt.valid {
+				if err == nil {
+					t.Error("Resolve() succeeded with a provider that must not be trusted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			assertAnswer(t, response[2:], 1)
+		})
+	}
+}
+
+func TestNewTLSConfigInvalid(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(empty, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		caFile string
+		pins   []string
+	}{
+		{name: "missing CA file", caFile: filepath.Join(t.TempDir(), "missing.pem")},
+		{name: "CA file without certificates", caFile: empty},
+		{name: "pin not base64", pins: []string{"not base64!"}},
+		{name: "pin not SHA-256", pins: []string{base64.StdEncoding.EncodeToString([]byte("short"))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewTLSConfig("localhost", tt.caFile, tt.pins); err == nil {
+				t.Error("NewTLSConfig() succeeded")
+			}
+		})
+	}
+}
+
+// writePEM writes the certificate in a PEM file and returns its path.
+func writePEM(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// spkiPin returns the SPKI pin of the certificate.
+func spkiPin(cert tls.Certificate) string {
+	hash := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
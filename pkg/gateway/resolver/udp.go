@@ -0,0 +1,106 @@
+package resolver
+
+import (
+	"dns-proxy/pkg/domain/proxy"
+	"dns-proxy/pkg/gateway/parser"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxUDPSize is the largest DNS message over UDP.
+const maxUDPSize = 65535
+
+// udpBufferSize is the size of the buffers reading the responses, the largest EDNS payload size commonly
+// advertised. Responses filling the buffer may have been cut, so they are requested again over TCP.
+const udpBufferSize = 4096
+
+// udpBuffers keeps the buffers reading the responses between queries.
+var udpBuffers = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, udpBufferSize)
+		return &buffer
+	},
+}
+
+// errDatagramTooLarge is returned by exchange when the response doesn't fit in the buffer.
+var errDatagramTooLarge = errors.New("response too large for a datagram buffer")
+
+// truncatedFlag is the TC bit in the high byte of the flags of the header.
+const truncatedFlag = 0x02
+
+// udpResolver speaks plain DNS over UDP, for the DNS servers of internal networks. Each query goes on its
+// own socket, so it gets a random source port. Responses truncated by the server, because they don't fit
+// in a datagram, or too large for the read buffer are requested again over TCP.
+type udpResolver struct {
+	address     string
+	readTimeOut uint
+	tcp         proxy.Resolver
+}
+
+// NewUDP returns a resolver for the DNS server at ip and port. The connections of the TCP fallback are
+// pooled like the ones of NewTCP.
+func NewUDP(ip string, port int, readTimeOut uint, poolSize int, idleTimeOut uint) proxy.Resolver {
+	return &udpResolver{
+		address:     net.JoinHostPort(ip, strconv.Itoa(port)),
+		readTimeOut: readTimeOut,
+		tcp:         NewTCP(ip, port, readTimeOut, poolSize, idleTimeOut),
+	}
+}
+
+// Resolve sends the request, given with the length prefix of TCP like to the other resolvers, in a datagram.
+// The response is returned with the length prefix as well.
+func (r *udpResolver) Resolve(request []byte) ([]byte, error) {
+	if len(request) < 4 {
+		return nil, errors.New("request too short")
+	}
+	response, err := r.exchange(request)
+	if errors.Is(err, errDatagramTooLarge) {
+		return r.tcp.Resolve(request)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(response) > 4 && response[4]&truncatedFlag != 0 {
+		return r.tcp.Resolve(request)
+	}
+	return response, nil
+}
+
+// exchange sends the request in a datagram and reads its response.
+func (r *udpResolver) exchange(request []byte) ([]byte, error) {
+	timeOut := time.Duration(r.readTimeOut) * time.Millisecond
+	conn, err := net.DialTimeout(proxy.SocketUDP, r.address, timeOut)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeOut)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(request[2:]); err != nil {
+		return nil, fmt.Errorf("could not send request to DNS server %s: %w", r.address, err)
+	}
+	buffer := udpBuffers.Get().(*[]byte)
+	defer udpBuffers.Put(buffer)
+	datagram := *buffer
+	for {
+		n, err := conn.Read(datagram)
+		if err != nil {
+			return nil, fmt.Errorf("could not read response from DNS server %s: %w", r.address, err)
+		}
+		// Datagrams that don't answer the query, like late responses to another one, are skipped.
+		if n < parser.MinMsgSize || datagram[0] != request[2] || datagram[1] != request[3] {
+			continue
+		}
+		if n == len(datagram) {
+			return nil, errDatagramTooLarge
+		}
+		response := binary.BigEndian.AppendUint16(make([]byte, 0, 2+n), uint16(n))
+		return append(response, datagram[:n]...), nil
+	}
+}
@@ -0,0 +1,84 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"testing"
+)
+
+// serveUDP answers the datagrams received by conn with the response built by respond.
+func serveUDP(conn net.PacketConn, respond func(request []byte) []byte) {
+	buffer := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		if response := respond(buffer[:n]); response != nil {
+			conn.WriteTo(response, addr)
+		}
+	}
+}
+
+// listenUDPTCP listens on the same port over TCP, answering with serveDNS, and over UDP.
+func listenUDPTCP(t *testing.T) (net.PacketConn, net.Listener) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go serveDNS(ln)
+	conn, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		t.Skipf("UDP port of the TCP listener not available: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, ln
+}
+
+func TestResolveUDP(t *testing.T) {
+	conn, ln := listenUDPTCP(t)
+	go serveUDP(conn, func(request []byte) []byte {
+		response, _ := answer(request)
+		return response
+	})
+	r := NewUDP("127.0.0.1", port(ln), 1000, 1, 60)
+	response, err := r.Resolve(query(t, 7, "example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := binary.BigEndian.Uint16(response); int(n) != len(response)-2 {
+		t.Errorf("length prefix = %d, want %d", n, len(response)-2)
+	}
+	assertAnswer(t, response[2:], 7)
+}
+
+// Responses that fill the read buffer may have been cut, so they are requested again over TCP.
+func TestResolveUDPLargeResponse(t *testing.T) {
+	conn, ln := listenUDPTCP(t)
+	go serveUDP(conn, func(request []byte) []byte {
+		response := make([]byte, udpBufferSize+100)
+		copy(response, request[:2])
+		return response
+	})
+	r := NewUDP("127.0.0.1", port(ln), 1000, 1, 60)
+	response, err := r.Resolve(query(t, 7, "example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAnswer(t, response[2:], 7)
+}
+
+// The error of a server that doesn't answer keeps the time out as cause.
+func TestResolveUDPTimeOut(t *testing.T) {
+	conn, ln := listenUDPTCP(t)
+	go serveUDP(conn, func([]byte) []byte { return nil })
+	r := NewUDP("127.0.0.1", port(ln), 50, 1, 60)
+	_, err := r.Resolve(query(t, 7, "example.com."))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Resolve() error = %v, want a time out", err)
+	}
+}